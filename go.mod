@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/hashicorp/vault/api v1.22.0
+	github.com/klauspost/compress v1.19.2
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.11.1
 )
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// StateInfo identifies one of the states being compared.
+type StateInfo struct {
+	Version int    `json:"version"`
+	Serial  int64  `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+// StateDiff lists the resource addresses that differ between two states.
+type StateDiff struct {
+	From    StateInfo `json:"from"`
+	To      StateInfo `json:"to"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	Changed []string  `json:"changed"`
+}
+
+type tfState struct {
+	Version   int          `json:"version"`
+	Serial    int64        `json:"serial"`
+	Lineage   string       `json:"lineage"`
+	Resources []tfResource `json:"resources"`
+}
+
+type tfResource struct {
+	Module    string       `json:"module"`
+	Mode      string       `json:"mode"`
+	Type      string       `json:"type"`
+	Name      string       `json:"name"`
+	Instances []tfInstance `json:"instances"`
+}
+
+type tfInstance struct {
+	IndexKey interface{} `json:"index_key"`
+	Data     map[string]interface{}
+}
+
+func (i *tfInstance) UnmarshalJSON(data []byte) error {
+
+	if err := json.Unmarshal(data, &i.Data); err != nil {
+
+		return err
+	}
+
+	i.IndexKey = i.Data["index_key"]
+
+	return nil
+}
+
+// address returns the Terraform address of the instance, i.e. module.network.aws_subnet.private[0].
+func (r *tfResource) address(instance *tfInstance) string {
+
+	var address strings.Builder
+	if r.Module != "" {
+
+		address.WriteString(r.Module + ".")
+	}
+	if r.Mode == "data" {
+
+		address.WriteString("data.")
+	}
+	address.WriteString(r.Type + "." + r.Name)
+
+	switch key := instance.IndexKey.(type) {
+
+	case float64:
+		address.WriteString(fmt.Sprintf("[%d]", int64(key)))
+	case string:
+		address.WriteString(fmt.Sprintf("[%q]", key))
+	}
+
+	return address.String()
+}
+
+func decodeState(data []byte) (*tfState, error) {
+
+	var state tfState
+	if err := json.Unmarshal(data, &state); err != nil {
+
+		return nil, err
+	}
+
+	if state.Version != 4 {
+
+		return nil, fmt.Errorf("unsupported state format version %d", state.Version)
+	}
+
+	return &state, nil
+}
+
+func (st *tfState) instances() map[string]map[string]interface{} {
+
+	instances := make(map[string]map[string]interface{})
+	for r := range st.Resources {
+
+		resource := &st.Resources[r]
+		for i := range resource.Instances {
+
+			instances[resource.address(&resource.Instances[i])] = resource.Instances[i].Data
+		}
+	}
+
+	return instances
+}
+
+// diffStates compares two Terraform states, in the JSON format version 4.
+func diffStates(fromVersion int, from []byte, toVersion int, to []byte) (*StateDiff, error) {
+
+	fromState, err := decodeState(from)
+	if err != nil {
+
+		return nil, fmt.Errorf("unable to decode version %d: %w", fromVersion, err)
+	}
+
+	toState, err := decodeState(to)
+	if err != nil {
+
+		return nil, fmt.Errorf("unable to decode version %d: %w", toVersion, err)
+	}
+
+	diff := &StateDiff{
+		From:    StateInfo{Version: fromVersion, Serial: fromState.Serial, Lineage: fromState.Lineage},
+		To:      StateInfo{Version: toVersion, Serial: toState.Serial, Lineage: toState.Lineage},
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+
+	fromInstances := fromState.instances()
+	toInstances := toState.instances()
+	for address, instance := range toInstances {
+
+		if previous, ok := fromInstances[address]; !ok {
+
+			diff.Added = append(diff.Added, address)
+
+		} else if !reflect.DeepEqual(previous, instance) {
+
+			diff.Changed = append(diff.Changed, address)
+		}
+	}
+	for address := range fromInstances {
+
+		if _, ok := toInstances[address]; !ok {
+
+			diff.Removed = append(diff.Removed, address)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff, nil
+}
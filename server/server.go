@@ -2,14 +2,22 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	s "github.com/gherynos/vault-backend/store"
+	"github.com/gherynos/vault-backend/vault"
 	"github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
 )
@@ -37,19 +45,86 @@ func checkLockID(store s.Store, state, id string) (proceed bool, data string, er
 	return
 }
 
-func stateHandlerGet(logger *log.Entry, store s.Store, state string, w http.ResponseWriter) (int, string) {
+// lockedVersions records the version of the states expected by the holders of their locks,
+// keyed by state and lock ID: the one read when acquiring the lock, then the one stored while holding it.
+// The states are stored using check-and-set with that version, so that the updates made by other writers
+// in the meantime are rejected rather than overwritten.
+var lockedVersions = struct {
+	versions map[string]int
+	mutex    sync.Mutex
+}{versions: make(map[string]int)}
+
+// lockedVersion returns the version of state expected by the holder of the lock id,
+// or -1 when unknown, i.e. when the lock was acquired through another instance of the server.
+func lockedVersion(state, id string) int {
+
+	lockedVersions.mutex.Lock()
+	defer lockedVersions.mutex.Unlock()
+
+	if version, ok := lockedVersions.versions[state+"\n"+id]; ok {
+
+		return version
+	}
+
+	return -1
+}
+
+// setLockedVersion records version as the one of state expected by the holder of the lock id,
+// forgetting it when negative.
+func setLockedVersion(state, id string, version int) {
+
+	lockedVersions.mutex.Lock()
+	defer lockedVersions.mutex.Unlock()
+
+	if version < 0 {
+
+		delete(lockedVersions.versions, state+"\n"+id)
+		return
+	}
+
+	lockedVersions.versions[state+"\n"+id] = version
+}
+
+// readLockedVersion records the latest version of state as the one expected by the holder of the lock id.
+func readLockedVersion(logger *log.Entry, store s.Store, state, id string) {
+
+	version, err := store.Version(state)
+	if err != nil {
+
+		logger.WithError(err).Warn("unable to read state version")
+		version = -1
+	}
+
+	setLockedVersion(state, id, version)
+}
+
+func stateHandlerGet(logger *log.Entry, store s.Store, state string, r *http.Request, w http.ResponseWriter) (int, string) {
 
 	logger.Debug("Load state")
 
-	data, err := store.GetBin(state)
+	// a previous version of the state can be requested, i.e. /state/...?version=...
+	var version int
+	if param := r.URL.Query().Get("version"); param != "" {
+
+		var err error
+		if version, err = strconv.Atoi(param); err != nil || version < 1 {
+
+			return http.StatusBadRequest, "invalid version"
+		}
+	}
+
+	data, err := store.GetBinVersion(state, version)
 	if err != nil {
 
 		var itemNotFoundError *s.ItemNotFoundError
+		var notSupportedError *s.NotSupportedError
 		var responseError *api.ResponseError
 		switch {
 
 		case errors.As(err, &itemNotFoundError):
 			return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+		case errors.As(err, &notSupportedError):
+			return http.StatusNotImplemented, notSupportedError.Error()
 		case errors.As(err, &responseError):
 			{
 				return responseError.StatusCode, responseError.Error()
@@ -76,7 +151,8 @@ func stateHandlerPost(logger *log.Entry, store s.Store, state string, r *http.Re
 
 	logger.Debug("Store state")
 
-	if proceed, data, err := checkLockID(store, state, r.URL.Query().Get("ID")); err != nil {
+	id := r.URL.Query().Get("ID")
+	if proceed, data, err := checkLockID(store, state, id); err != nil {
 
 		var itemNotFoundError *s.ItemNotFoundError
 		var responseError *api.ResponseError
@@ -108,11 +184,18 @@ func stateHandlerPost(logger *log.Entry, store s.Store, state string, r *http.Re
 		return http.StatusBadRequest, http.StatusText(http.StatusBadRequest)
 	}
 
-	if err := store.SetBin(state, reqBody); err != nil {
+	version, err := store.SetBinVersion(state, reqBody, lockedVersion(state, id))
+	if err != nil {
 
+		var versionConflictError *s.VersionConflictError
 		var responseError *api.ResponseError
 		switch {
 
+		case errors.As(err, &versionConflictError):
+			{
+				logger.Warn("state modified concurrently")
+				return http.StatusConflict, http.StatusText(http.StatusConflict)
+			}
 		case errors.As(err, &responseError):
 			{
 				return responseError.StatusCode, responseError.Error()
@@ -125,6 +208,8 @@ func stateHandlerPost(logger *log.Entry, store s.Store, state string, r *http.Re
 		}
 	}
 
+	setLockedVersion(state, id, version)
+
 	return 200, ""
 }
 
@@ -132,7 +217,47 @@ func stateHandlerLock(logger *log.Entry, store s.Store, state string, r *http.Re
 
 	logger.Debug("Lock state")
 
+	var reqBody []byte
+	var err error
+	if reqBody, err = io.ReadAll(r.Body); err != nil {
+
+		return http.StatusBadRequest, http.StatusText(http.StatusBadRequest)
+	}
+
+	// the lock is created only if not already present, so that a single caller can acquire it
 	name := fmt.Sprintf("%s-lock", state)
+	if err = store.CreateBin(name, reqBody); err == nil {
+
+		// the state is then stored using check-and-set with the version read while holding the lock
+		var lockInfo map[string]interface{}
+		if err := json.Unmarshal(reqBody, &lockInfo); err == nil {
+
+			if id, ok := lockInfo["ID"].(string); ok {
+
+				readLockedVersion(logger, store, state, id)
+			}
+		}
+
+		return 200, ""
+	}
+
+	var itemAlreadyExistsError *s.ItemAlreadyExistsError
+	var responseError *api.ResponseError
+	switch {
+
+	case errors.As(err, &itemAlreadyExistsError):
+		logger.Debug("State already locked")
+	case errors.As(err, &responseError):
+		{
+			return responseError.StatusCode, responseError.Error()
+		}
+	default:
+		{
+			logger.WithError(err).Error("unable to store lock")
+			return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+		}
+	}
+
 	data, err := store.GetBin(name)
 	if err != nil {
 
@@ -141,22 +266,7 @@ func stateHandlerLock(logger *log.Entry, store s.Store, state string, r *http.Re
 		switch {
 
 		case errors.As(err, &itemNotFoundError):
-			{
-				var reqBody []byte
-				var err error
-				if reqBody, err = io.ReadAll(r.Body); err != nil {
-
-					return http.StatusBadRequest, http.StatusText(http.StatusBadRequest)
-				}
-
-				if err := store.SetBin(name, reqBody); err != nil {
-
-					logger.WithError(err).Error("unable to store lock")
-					return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
-				}
-
-				return 200, ""
-			}
+			return http.StatusConflict, "lock released while acquiring it"
 		case errors.As(err, &responseError):
 			{
 				return responseError.StatusCode, responseError.Error()
@@ -173,7 +283,7 @@ func stateHandlerLock(logger *log.Entry, store s.Store, state string, r *http.Re
 	return http.StatusConflict, string(data)
 }
 
-func stateHandlerUnlock(logger *log.Entry, store s.Store, state string, pool s.Pool, userPassEnc string, r *http.Request, w http.ResponseWriter) (int, string) {
+func stateHandlerUnlock(logger *log.Entry, store s.Store, state string, pool s.Pool, userPassEnc, namespace string, clientCert *x509.Certificate, r *http.Request, w http.ResponseWriter) (int, string) {
 
 	logger.Debug("Unlock state")
 
@@ -190,7 +300,8 @@ func stateHandlerUnlock(logger *log.Entry, store s.Store, state string, pool s.P
 		return http.StatusBadRequest, http.StatusText(http.StatusBadRequest)
 	}
 
-	if proceed, data, err := checkLockID(store, state, body["ID"].(string)); err != nil {
+	id, _ := body["ID"].(string)
+	if proceed, data, err := checkLockID(store, state, id); err != nil {
 
 		var itemNotFoundError *s.ItemNotFoundError
 		var responseError *api.ResponseError
@@ -232,11 +343,312 @@ func stateHandlerUnlock(logger *log.Entry, store s.Store, state string, pool s.P
 		}
 	}
 
-	pool.Delete(userPassEnc)
+	setLockedVersion(state, id, -1)
+	pool.Delete(userPassEnc, namespace, clientCert)
+
+	return 200, ""
+}
+
+func stateHandlerVersions(logger *log.Entry, store s.Store, state string, w http.ResponseWriter) (int, string) {
+
+	logger.Debug("Load state versions")
+
+	metadata, err := store.Metadata(state)
+	if err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		var notSupportedError *s.NotSupportedError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &itemNotFoundError):
+			return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+		case errors.As(err, &notSupportedError):
+			return http.StatusNotImplemented, notSupportedError.Error()
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to get state versions")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+
+		logger.WithError(err).Error("unable to return state versions")
+		return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	}
+
+	return 200, ""
+}
+
+func stateHandlerRollback(logger *log.Entry, store s.Store, state string, r *http.Request, w http.ResponseWriter) (int, string) {
+
+	logger.Debug("Rollback state")
+
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version < 1 {
+
+		return http.StatusBadRequest, "invalid version"
+	}
+
+	id := r.URL.Query().Get("ID")
+	if proceed, data, err := checkLockID(store, state, id); err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &itemNotFoundError):
+			return http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity)
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to check lock")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+
+	} else if !proceed {
+
+		w.Header().Set("Content-Type", "application/json")
+		return http.StatusLocked, data
+	}
+
+	data, err := store.GetBinVersion(state, version)
+	if err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		var notSupportedError *s.NotSupportedError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &itemNotFoundError):
+			return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+		case errors.As(err, &notSupportedError):
+			return http.StatusNotImplemented, notSupportedError.Error()
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to get state version")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	// the previous version becomes the latest one
+	latest, err := store.SetBinVersion(state, data, lockedVersion(state, id))
+	if err != nil {
+
+		var versionConflictError *s.VersionConflictError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &versionConflictError):
+			{
+				logger.Warn("state modified concurrently")
+				return http.StatusConflict, http.StatusText(http.StatusConflict)
+			}
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to store state")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	setLockedVersion(state, id, latest)
+
+	logger.Infof("State rolled back to version %d", version)
+
+	return 200, ""
+}
+
+func stateHandlerDiff(logger *log.Entry, store s.Store, state string, r *http.Request, w http.ResponseWriter) (int, string) {
+
+	logger.Debug("Diff state versions")
+
+	versions := make([]int, 2)
+	data := make([][]byte, 2)
+	for i, param := range []string{"from", "to"} {
+
+		version, err := strconv.Atoi(r.URL.Query().Get(param))
+		if err != nil || version < 1 {
+
+			return http.StatusBadRequest, "invalid " + param + " version"
+		}
+		versions[i] = version
+
+		data[i], err = store.GetBinVersion(state, version)
+		if err != nil {
+
+			var itemNotFoundError *s.ItemNotFoundError
+			var notSupportedError *s.NotSupportedError
+			var responseError *api.ResponseError
+			switch {
+
+			case errors.As(err, &itemNotFoundError):
+				return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+			case errors.As(err, &notSupportedError):
+				return http.StatusNotImplemented, notSupportedError.Error()
+			case errors.As(err, &responseError):
+				{
+					return responseError.StatusCode, responseError.Error()
+				}
+			default:
+				{
+					logger.WithError(err).Error("unable to get state version")
+					return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+				}
+			}
+		}
+	}
+
+	diff, err := diffStates(versions[0], data[0], versions[1], data[1])
+	if err != nil {
+
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+
+		logger.WithError(err).Error("unable to return state diff")
+		return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	}
+
+	return 200, ""
+}
+
+func stateHandlerUpgrade(logger *log.Entry, store s.Store, state string, r *http.Request, w http.ResponseWriter) (int, string) {
+
+	logger.Debug("Upgrade state")
+
+	id := r.URL.Query().Get("ID")
+	if proceed, data, err := checkLockID(store, state, id); err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &itemNotFoundError):
+			return http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity)
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to check lock")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+
+	} else if !proceed {
+
+		w.Header().Set("Content-Type", "application/json")
+		return http.StatusLocked, data
+	}
+
+	upgraded, err := store.Upgrade(state)
+	if err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		var versionConflictError *s.VersionConflictError
+		var responseError *api.ResponseError
+		switch {
+
+		case errors.As(err, &itemNotFoundError):
+			return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+		case errors.As(err, &versionConflictError):
+			{
+				logger.Warn("state modified concurrently")
+				return http.StatusConflict, http.StatusText(http.StatusConflict)
+			}
+		case errors.As(err, &responseError):
+			{
+				return responseError.StatusCode, responseError.Error()
+			}
+		default:
+			{
+				logger.WithError(err).Error("unable to upgrade state")
+				return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	if upgraded {
+
+		logger.Info("State upgraded")
+		readLockedVersion(logger, store, state, id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{"upgraded": upgraded}); err != nil {
+
+		logger.WithError(err).Error("unable to return upgrade result")
+		return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	}
 
 	return 200, ""
 }
 
+// stateActions are the operations available on a state via /state/<name>?action=<action>,
+// so that any state name remains addressable.
+var stateActions = []string{"versions", "rollback", "diff", "upgrade"}
+
+func stateActionHandler(logger *log.Entry, store s.Store, state, action string, r *http.Request, w http.ResponseWriter) (int, string) {
+
+	switch {
+
+	case action == "versions" && r.Method == "GET":
+		{
+			return stateHandlerVersions(logger, store, state, w)
+		}
+
+	case action == "rollback" && r.Method == "POST":
+		{
+			return stateHandlerRollback(logger, store, state, r, w)
+		}
+
+	case action == "diff" && r.Method == "GET":
+		{
+			return stateHandlerDiff(logger, store, state, r, w)
+		}
+
+	case action == "upgrade" && r.Method == "POST":
+		{
+			return stateHandlerUpgrade(logger, store, state, r, w)
+		}
+
+	case !slices.Contains(stateActions, action):
+		{
+			return http.StatusBadRequest, "invalid action"
+		}
+
+	default:
+		{
+			logger.Warnf("Method %s not allowed on %s", r.Method, action)
+			return http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
 func stateHandler(pool s.Pool, w http.ResponseWriter, r *http.Request) (int, string) {
 
 	state := r.URL.Path[7:] // /state/...
@@ -250,14 +662,30 @@ func stateHandler(pool s.Pool, w http.ResponseWriter, r *http.Request) (int, str
 	}
 	userPassEnc = userPassEnc[6:] // Basic ...
 
+	// the namespace can be overridden per state, i.e. /state/...?namespace=...
+	namespace := r.URL.Query().Get("namespace")
+
+	// only the certificates verified against TLS_CLIENT_CA are passed to the pool
+	var clientCert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+
+		clientCert = r.TLS.VerifiedChains[0][0]
+	}
+
 	var store s.Store
 	var err error
-	store, err = pool.Get(userPassEnc)
+	store, err = pool.Get(userPassEnc, namespace, clientCert)
 	if err != nil {
 
+		var unauthorizedError *s.UnauthorizedError
 		var responseError *api.ResponseError
 		switch {
 
+		case errors.As(err, &unauthorizedError):
+			{
+				logger.Debugf("invalid credentials: %s", unauthorizedError.Error())
+				return http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)
+			}
 		case errors.As(err, &responseError):
 			{
 				logger.Debugf("error connecting to Vault: %d - %s", responseError.StatusCode, responseError.Error())
@@ -271,11 +699,17 @@ func stateHandler(pool s.Pool, w http.ResponseWriter, r *http.Request) (int, str
 		}
 	}
 
+	// the operations other than the ones of the HTTP backend are selected with the action parameter
+	if action := r.URL.Query().Get("action"); action != "" {
+
+		return stateActionHandler(logger, store, state, action, r, w)
+	}
+
 	switch r.Method {
 
 	case "GET":
 		{
-			return stateHandlerGet(logger, store, state, w)
+			return stateHandlerGet(logger, store, state, r, w)
 		}
 
 	case "POST":
@@ -290,7 +724,7 @@ func stateHandler(pool s.Pool, w http.ResponseWriter, r *http.Request) (int, str
 
 	case "UNLOCK":
 		{
-			return stateHandlerUnlock(logger, store, state, pool, userPassEnc, r, w)
+			return stateHandlerUnlock(logger, store, state, pool, userPassEnc, namespace, clientCert, r, w)
 		}
 
 	default:
@@ -324,6 +758,120 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// clientAuthTLSConfig returns a TLS configuration verifying the certificates presented by the clients
+// against the CAs in the caFile, while still accepting clients authenticating with other methods.
+func clientAuthTLSConfig(caFile string) (*tls.Config, error) {
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven, MinVersion: tls.VersionTLS12}, nil
+}
+
+// parseDuration parses a duration like time.ParseDuration, additionally accepting a number of days (i.e. 90d).
+func parseDuration(value string) (time.Duration, error) {
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+
+		count, err := strconv.Atoi(days)
+		if err != nil {
+
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// parseRetention parses the maximum number of versions and the optional deletion time of a retention setting.
+// As KV version 2 deletes the current version of the secrets as well once expired,
+// the deletion time is refused unless allowDeleteVersionAfter is set.
+func parseRetention(maxVersions, deleteVersionAfter string, allowDeleteVersionAfter bool) (retention vault.Retention, err error) {
+
+	if retention.MaxVersions, err = strconv.Atoi(maxVersions); err != nil || retention.MaxVersions < 0 {
+
+		return retention, fmt.Errorf("invalid maximum number of versions %q", maxVersions)
+	}
+
+	if deleteVersionAfter != "" {
+
+		if !allowDeleteVersionAfter {
+
+			return retention, errors.New("the deletion time removes the current version of the states as well, and requires VAULT_ALLOW_DELETE_VERSION_AFTER")
+		}
+
+		if retention.DeleteVersionAfter, err = parseDuration(deleteVersionAfter); err != nil {
+
+			return
+		}
+	}
+
+	return retention, nil
+}
+
+// parseRetentionOverrides parses a comma separated list of <pattern>=<max_versions>[:<delete_version_after>].
+func parseRetentionOverrides(value string, allowDeleteVersionAfter bool) (overrides []vault.RetentionOverride, err error) {
+
+	if value == "" {
+
+		return nil, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+
+		pattern, settings, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || pattern == "" {
+
+			return nil, fmt.Errorf("invalid retention override %q", entry)
+		}
+
+		maxVersions, deleteVersionAfter, _ := strings.Cut(settings, ":")
+
+		override := vault.RetentionOverride{Pattern: pattern}
+		if override.Retention, err = parseRetention(maxVersions, deleteVersionAfter, allowDeleteVersionAfter); err != nil {
+
+			return nil, err
+		}
+		overrides = append(overrides, override)
+	}
+
+	return overrides, nil
+}
+
+// parseCertRoles parses a comma separated list of <common_name>=<role>,
+// mapping the subject common name of the client certificates to the Vault role they can authenticate with.
+func parseCertRoles(value string) (roles map[string]string, err error) {
+
+	roles = make(map[string]string)
+	if value == "" {
+
+		return
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+
+		commonName, role, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || commonName == "" || role == "" {
+
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		roles[commonName] = role
+	}
+
+	return roles, nil
+}
+
 // RunServer starts the Vault Backend TCP server
 func RunServer() {
 
@@ -336,18 +884,163 @@ func RunServer() {
 	vaultURL := getEnv("VAULT_URL", "http://localhost:8200")
 	vaultPrefix := getEnv("VAULT_PREFIX", "vbk")
 	vaultStore := getEnv("VAULT_STORE", "secret")
+	vaultNamespace := getEnv("VAULT_NAMESPACE", "")
+	vaultAppRoleMount := getEnv("VAULT_APPROLE_MOUNT", "approle")
+	vaultCertAuthDir := getEnv("VAULT_CERT_AUTH_DIR", "")
 	address := getEnv("LISTEN_ADDRESS", ":8080")
 	tlsCrt := getEnv("TLS_CRT", "")
 	tlsKey := getEnv("TLS_KEY", "")
+	tlsClientCA := getEnv("TLS_CLIENT_CA", "")
 
 	log.Infof("Vault Backend version %s listening on %s", Version, address)
 	log.Debugf("Vault URL: %s, secret prefix: %s", vaultURL, vaultPrefix)
 
-	http.Handle("/state/", handler{NewVaultPool(vaultURL, vaultPrefix, vaultStore), stateHandler})
+	vaultSkipVerify, err := strconv.ParseBool(getEnv("VAULT_SKIP_VERIFY", "false"))
+	if err != nil {
+
+		log.Fatalf("invalid VAULT_SKIP_VERIFY value: %s", err)
+	}
+
+	var vaultKVVersion int
+	switch getEnv("VAULT_KV_VERSION", "") {
+
+	case "":
+		vaultKVVersion = 0 // detected from the mount
+	case "1":
+		vaultKVVersion = vault.KVv1
+	case "2":
+		vaultKVVersion = vault.KVv2
+	default:
+		log.Fatal("invalid VAULT_KV_VERSION value, it must be either 1 or 2")
+	}
+	vaultChunkSize, err := strconv.Atoi(getEnv("VAULT_CHUNK_SIZE", "0"))
+	if err != nil || vaultChunkSize < 0 {
+
+		log.Fatal("invalid VAULT_CHUNK_SIZE value, it must be a positive number of bytes")
+	}
+
+	vaultAllowDeleteVersionAfter, err := strconv.ParseBool(getEnv("VAULT_ALLOW_DELETE_VERSION_AFTER", "false"))
+	if err != nil {
+
+		log.Fatalf("invalid VAULT_ALLOW_DELETE_VERSION_AFTER value: %s", err)
+	}
+	if vaultAllowDeleteVersionAfter {
+
+		log.Warn("VAULT_ALLOW_DELETE_VERSION_AFTER is set: states not updated within the deletion time are deleted")
+	}
+
+	var vaultRetention *vault.Retention
+	vaultMaxVersions, maxVersionsSet := os.LookupEnv("VAULT_MAX_VERSIONS")
+	vaultDeleteVersionAfter, deleteVersionAfterSet := os.LookupEnv("VAULT_DELETE_VERSION_AFTER")
+	if maxVersionsSet || deleteVersionAfterSet {
+
+		if !maxVersionsSet {
+
+			vaultMaxVersions = "0"
+		}
+
+		retention, err := parseRetention(vaultMaxVersions, vaultDeleteVersionAfter, vaultAllowDeleteVersionAfter)
+		if err != nil {
+
+			log.Fatalf("invalid retention settings: %s", err)
+		}
+		vaultRetention = &retention
+	}
+	vaultRetentionOverrides, err := parseRetentionOverrides(getEnv("VAULT_RETENTION_OVERRIDES", ""), vaultAllowDeleteVersionAfter)
+	if err != nil {
+
+		log.Fatalf("invalid VAULT_RETENTION_OVERRIDES value: %s", err)
+	}
+
+	vaultCodec, err := vault.ParseCodec(getEnv("VAULT_CODEC", ""))
+	if err != nil {
+
+		log.Fatal("invalid VAULT_CODEC value, it must be one of zlib, gzip, zstd or none")
+	}
+
+	vaultFormat, err := vault.ParseFormat(getEnv("VAULT_FORMAT", ""))
+	if err != nil {
+
+		log.Fatal("invalid VAULT_FORMAT value, it must be one of encoded, text or json")
+	}
+
+	var vaultKeyring *vault.Keyring
+	vaultEncryptionKeys := getEnv("VAULT_ENCRYPTION_KEYS", "")
+	if keysFile := getEnv("VAULT_ENCRYPTION_KEYS_FILE", ""); keysFile != "" {
+
+		keys, err := os.ReadFile(keysFile)
+		if err != nil {
+
+			log.Fatalf("unable to read VAULT_ENCRYPTION_KEYS_FILE: %s", err)
+		}
+		vaultEncryptionKeys = string(keys)
+	}
+	if vaultEncryptionKeys != "" {
+
+		if vaultKeyring, err = vault.ParseKeyring(vaultEncryptionKeys); err != nil {
+
+			log.Fatalf("invalid encryption keys: %s", err)
+		}
+	}
+
+	if vaultFormat != vault.FormatEncoded && (vaultKeyring != nil || getEnv("VAULT_TRANSIT_MOUNT", "") != "") {
+
+		log.Fatal("the states can't be encrypted when VAULT_FORMAT is text or json")
+	}
+
+	if vaultKVVersion == vault.KVv1 {
+
+		vault.WarnKVv1()
+	}
+
+	vaultConfig := vault.Config{
+		URL:                vaultURL,
+		Namespace:          vaultNamespace,
+		Prefix:             vaultPrefix,
+		Store:              vaultStore,
+		KVVersion:          vaultKVVersion,
+		ChunkSize:          vaultChunkSize,
+		Retention:          vaultRetention,
+		RetentionOverrides: vaultRetentionOverrides,
+		Format:             vaultFormat,
+		Codec:              vaultCodec,
+		Keyring:            vaultKeyring,
+		TransitMount:       getEnv("VAULT_TRANSIT_MOUNT", ""),
+		TransitKey:         getEnv("VAULT_TRANSIT_KEY", ""),
+		TLS: api.TLSConfig{
+			CACert:        getEnv("VAULT_CACERT", ""),
+			CAPath:        getEnv("VAULT_CAPATH", ""),
+			ClientCert:    getEnv("VAULT_CLIENT_CERT", ""),
+			ClientKey:     getEnv("VAULT_CLIENT_KEY", ""),
+			TLSServerName: getEnv("VAULT_TLS_SERVER_NAME", ""),
+			Insecure:      vaultSkipVerify,
+		},
+	}
+
+	vaultCertAuthRoles, err := parseCertRoles(getEnv("VAULT_CERT_AUTH_ROLES", ""))
+	if err != nil {
+
+		log.Fatalf("invalid VAULT_CERT_AUTH_ROLES value: %s", err)
+	}
+	if len(vaultCertAuthRoles) > 0 && (vaultCertAuthDir == "" || tlsClientCA == "" || tlsCrt == "" || tlsKey == "") {
+
+		log.Fatal("VAULT_CERT_AUTH_ROLES requires VAULT_CERT_AUTH_DIR, TLS_CLIENT_CA, TLS_CRT and TLS_KEY")
+	}
+
+	http.Handle("/state/", handler{NewVaultPool(vaultConfig, vaultAppRoleMount, vaultCertAuthDir, vaultCertAuthRoles), stateHandler})
 
 	if tlsCrt != "" && tlsKey != "" {
 
-		log.Fatal(http.ListenAndServeTLS(address, tlsCrt, tlsKey, nil))
+		server := &http.Server{Addr: address}
+		if tlsClientCA != "" {
+
+			if server.TLSConfig, err = clientAuthTLSConfig(tlsClientCA); err != nil {
+
+				log.Fatalf("unable to load the client CA certificates: %s", err)
+			}
+		}
+
+		log.Fatal(server.ListenAndServeTLS(tlsCrt, tlsKey))
 
 	} else {
 
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	s "github.com/gherynos/vault-backend/store"
+	"github.com/gherynos/vault-backend/vault"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -41,6 +47,47 @@ func (suite *ServerTestSuite) TestUnauthorised() {
 	assert.Equal(suite.T(), rr.Code, http.StatusUnauthorized)
 }
 
+func (suite *ServerTestSuite) TestInvalidCredentials() {
+
+	req, err := http.NewRequest("GET", "/state/sample", nil)
+	if err != nil {
+
+		suite.T().Fatal(err)
+	}
+	req.Header.Set("Authorization", "Basic invalidID")
+
+	rr := httptest.NewRecorder()
+	handler := handler{suite.pool, stateHandler}
+
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(suite.T(), http.StatusUnauthorized, rr.Code)
+}
+
+func (suite *ServerTestSuite) TestClientCertificate() {
+
+	req, err := http.NewRequest("GET", "/state/sample", nil)
+	if err != nil {
+
+		suite.T().Fatal(err)
+	}
+	req.Header.Set("Authorization", suite.auth)
+
+	handler := handler{suite.pool, stateHandler}
+
+	// unverified certificates are ignored
+	cert := &x509.Certificate{Raw: []byte("cert")}
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Nil(suite.T(), suite.pool.(*MockPool).clientCert)
+
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(suite.T(), cert, suite.pool.(*MockPool).clientCert)
+}
+
 func (suite *ServerTestSuite) TestStateNotFound() {
 
 	req, err := http.NewRequest("GET", "/state/sample", nil)
@@ -75,7 +122,7 @@ func (suite *ServerTestSuite) TestHappyPath() {
 	handler.ServeHTTP(rr, lReq)
 	assert.Equal(suite.T(), http.StatusOK, rr.Code)
 
-	store, sErr := suite.pool.Get(suite.creds)
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
 
 	assert.Nil(suite.T(), sErr)
 
@@ -153,7 +200,7 @@ func (suite *ServerTestSuite) TestLockedState() {
 	handler.ServeHTTP(rr, lReq)
 	assert.Equal(suite.T(), http.StatusOK, rr.Code)
 
-	store, sErr := suite.pool.Get(suite.creds)
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
 
 	assert.Nil(suite.T(), sErr)
 
@@ -194,6 +241,401 @@ func (suite *ServerTestSuite) TestLockedState() {
 	assert.Equal(suite.T(), lock, strings.Trim(rr2.Body.String(), "\n"))
 }
 
+func (suite *ServerTestSuite) TestStateVersion() {
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("sample5", []byte("{\"serial\": 1}")))
+	assert.Nil(suite.T(), store.SetBin("sample5", []byte("{\"serial\": 2}")))
+
+	handler := handler{suite.pool, stateHandler}
+
+	// load previous version
+	gReq, gErr := http.NewRequest("GET", "/state/sample5?version=1", nil)
+	if gErr != nil {
+
+		suite.T().Fatal(gErr)
+	}
+	gReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, gReq)
+	assert.Equal(suite.T(), http.StatusOK, rr.Code)
+	assert.Equal(suite.T(), "{\"serial\": 1}", rr.Body.String())
+
+	// load missing version
+	mReq, mErr := http.NewRequest("GET", "/state/sample5?version=3", nil)
+	if mErr != nil {
+
+		suite.T().Fatal(mErr)
+	}
+	mReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, mReq)
+	assert.Equal(suite.T(), http.StatusNotFound, rr2.Code)
+
+	// load versions
+	vReq, vErr := http.NewRequest("GET", "/state/sample5?action=versions", nil)
+	if vErr != nil {
+
+		suite.T().Fatal(vErr)
+	}
+	vReq.Header.Set("Authorization", suite.auth)
+
+	rr4 := httptest.NewRecorder()
+	handler.ServeHTTP(rr4, vReq)
+	assert.Equal(suite.T(), http.StatusOK, rr4.Code)
+
+	var metadata s.Metadata
+	assert.Nil(suite.T(), json.Unmarshal(rr4.Body.Bytes(), &metadata))
+	assert.Equal(suite.T(), 2, metadata.CurrentVersion)
+	assert.Len(suite.T(), metadata.Versions, 2)
+
+	// load invalid version
+	iReq, iErr := http.NewRequest("GET", "/state/sample5?version=latest", nil)
+	if iErr != nil {
+
+		suite.T().Fatal(iErr)
+	}
+	iReq.Header.Set("Authorization", suite.auth)
+
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, iReq)
+	assert.Equal(suite.T(), http.StatusBadRequest, rr3.Code)
+
+	// load unknown action
+	aReq, aErr := http.NewRequest("GET", "/state/sample5?action=history", nil)
+	if aErr != nil {
+
+		suite.T().Fatal(aErr)
+	}
+	aReq.Header.Set("Authorization", suite.auth)
+
+	rr5 := httptest.NewRecorder()
+	handler.ServeHTTP(rr5, aReq)
+	assert.Equal(suite.T(), http.StatusBadRequest, rr5.Code)
+}
+
+func (suite *ServerTestSuite) TestStateNamedAfterAction() {
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("team/versions", []byte("{\"serial\": 1}")))
+
+	handler := handler{suite.pool, stateHandler}
+
+	gReq, gErr := http.NewRequest("GET", "/state/team/versions", nil)
+	if gErr != nil {
+
+		suite.T().Fatal(gErr)
+	}
+	gReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, gReq)
+	assert.Equal(suite.T(), http.StatusOK, rr.Code)
+	assert.Equal(suite.T(), "{\"serial\": 1}", rr.Body.String())
+}
+
+func (suite *ServerTestSuite) TestRollback() {
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("sample6", []byte("{\"serial\": 1}")))
+	assert.Nil(suite.T(), store.SetBin("sample6", []byte("{\"serial\": 2}")))
+
+	handler := handler{suite.pool, stateHandler}
+
+	// rollback without lock
+	rReq, rErr := http.NewRequest("POST", "/state/sample6?action=rollback&version=1&ID=sampleLocked6", nil)
+	if rErr != nil {
+
+		suite.T().Fatal(rErr)
+	}
+	rReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, rReq)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, rr.Code)
+
+	// lock state
+	lock := "{\"ID\": \"sampleLocked6\"}"
+	assert.Nil(suite.T(), store.CreateBin("sample6-lock", []byte(lock)))
+
+	// rollback with wrong lock ID
+	wReq, wErr := http.NewRequest("POST", "/state/sample6?action=rollback&version=1&ID=wrongvalue", nil)
+	if wErr != nil {
+
+		suite.T().Fatal(wErr)
+	}
+	wReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, wReq)
+	assert.Equal(suite.T(), http.StatusLocked, rr2.Code)
+
+	// rollback
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, rReq)
+	assert.Equal(suite.T(), http.StatusOK, rr3.Code)
+
+	st, stErr := store.GetBin("sample6")
+
+	assert.Nil(suite.T(), stErr)
+
+	assert.Equal(suite.T(), "{\"serial\": 1}", string(st))
+
+	metadata, mErr := store.Metadata("sample6")
+
+	assert.Nil(suite.T(), mErr)
+
+	assert.Equal(suite.T(), 3, metadata.CurrentVersion)
+}
+
+func (suite *ServerTestSuite) TestStateDiff() {
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("sample7", []byte(`{"version": 4, "serial": 1, "lineage": "abc", "resources": [
+		{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [{"index_key": 0, "attributes": {"ami": "a"}}]},
+		{"mode": "data", "type": "aws_ami", "name": "base", "instances": [{"attributes": {"id": "a"}}]},
+		{"module": "module.net", "mode": "managed", "type": "aws_subnet", "name": "private", "instances": [{"index_key": "a", "attributes": {}}]}
+	]}`)))
+	assert.Nil(suite.T(), store.SetBin("sample7", []byte(`{"version": 4, "serial": 2, "lineage": "abc", "resources": [
+		{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [{"index_key": 0, "attributes": {"ami": "b"}}, {"index_key": 1, "attributes": {"ami": "b"}}]},
+		{"mode": "data", "type": "aws_ami", "name": "base", "instances": [{"attributes": {"id": "a"}}]}
+	]}`)))
+	assert.Nil(suite.T(), store.SetBin("sample7", []byte("not a state")))
+
+	handler := handler{suite.pool, stateHandler}
+
+	// diff versions
+	dReq, dErr := http.NewRequest("GET", "/state/sample7?action=diff&from=1&to=2", nil)
+	if dErr != nil {
+
+		suite.T().Fatal(dErr)
+	}
+	dReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, dReq)
+	assert.Equal(suite.T(), http.StatusOK, rr.Code)
+
+	var diff StateDiff
+	assert.Nil(suite.T(), json.Unmarshal(rr.Body.Bytes(), &diff))
+	assert.Equal(suite.T(), StateInfo{Version: 1, Serial: 1, Lineage: "abc"}, diff.From)
+	assert.Equal(suite.T(), StateInfo{Version: 2, Serial: 2, Lineage: "abc"}, diff.To)
+	assert.Equal(suite.T(), []string{"aws_instance.web[1]"}, diff.Added)
+	assert.Equal(suite.T(), []string{"module.net.aws_subnet.private[\"a\"]"}, diff.Removed)
+	assert.Equal(suite.T(), []string{"aws_instance.web[0]"}, diff.Changed)
+
+	// diff missing version
+	mReq, mErr := http.NewRequest("GET", "/state/sample7?action=diff&from=1&to=4", nil)
+	if mErr != nil {
+
+		suite.T().Fatal(mErr)
+	}
+	mReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, mReq)
+	assert.Equal(suite.T(), http.StatusNotFound, rr2.Code)
+
+	// diff invalid state
+	iReq, iErr := http.NewRequest("GET", "/state/sample7?action=diff&from=2&to=3", nil)
+	if iErr != nil {
+
+		suite.T().Fatal(iErr)
+	}
+	iReq.Header.Set("Authorization", suite.auth)
+
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, iReq)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, rr3.Code)
+
+	// diff without versions
+	nReq, nErr := http.NewRequest("GET", "/state/sample7?action=diff&from=1", nil)
+	if nErr != nil {
+
+		suite.T().Fatal(nErr)
+	}
+	nReq.Header.Set("Authorization", suite.auth)
+
+	rr4 := httptest.NewRecorder()
+	handler.ServeHTTP(rr4, nReq)
+	assert.Equal(suite.T(), http.StatusBadRequest, rr4.Code)
+}
+
+func (suite *ServerTestSuite) TestUpgrade() {
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("sample8", []byte("{\"serial\": 1}")))
+	store.(*MockStore).outdated["sample8"] = true
+
+	handler := handler{suite.pool, stateHandler}
+
+	uReq, uErr := http.NewRequest("POST", "/state/sample8?action=upgrade&ID=sampleLocked8", nil)
+	if uErr != nil {
+
+		suite.T().Fatal(uErr)
+	}
+	uReq.Header.Set("Authorization", suite.auth)
+
+	// upgrade unlocked state
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, uReq)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, rr.Code)
+
+	// states are left as they are when locked
+	lReq, lErr := http.NewRequest("LOCK", "/state/sample8", strings.NewReader("{\"ID\": \"sampleLocked8\"}"))
+	if lErr != nil {
+
+		suite.T().Fatal(lErr)
+	}
+	lReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, lReq)
+	assert.Equal(suite.T(), http.StatusOK, rr2.Code)
+
+	metadata, mErr := store.Metadata("sample8")
+
+	assert.Nil(suite.T(), mErr)
+
+	assert.Equal(suite.T(), 1, metadata.CurrentVersion)
+
+	// upgrade with a different lock ID
+	wReq, wErr := http.NewRequest("POST", "/state/sample8?action=upgrade&ID=otherLock", nil)
+	if wErr != nil {
+
+		suite.T().Fatal(wErr)
+	}
+	wReq.Header.Set("Authorization", suite.auth)
+
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, wReq)
+	assert.Equal(suite.T(), http.StatusLocked, rr3.Code)
+
+	// upgrade outdated state
+	rr4 := httptest.NewRecorder()
+	handler.ServeHTTP(rr4, uReq)
+	assert.Equal(suite.T(), http.StatusOK, rr4.Code)
+	assert.JSONEq(suite.T(), "{\"upgraded\": true}", rr4.Body.String())
+
+	// upgrade current state
+	rr5 := httptest.NewRecorder()
+	handler.ServeHTTP(rr5, uReq)
+	assert.Equal(suite.T(), http.StatusOK, rr5.Code)
+	assert.JSONEq(suite.T(), "{\"upgraded\": false}", rr5.Body.String())
+
+	metadata, mErr = store.Metadata("sample8")
+
+	assert.Nil(suite.T(), mErr)
+
+	assert.Equal(suite.T(), 2, metadata.CurrentVersion)
+}
+
+func (suite *ServerTestSuite) TestStoreStateConflict() {
+
+	// lock state
+	lock := "{\"ID\": \"sampleLocked4\"}"
+	lReq, lErr := http.NewRequest("LOCK", "/state/sample4", strings.NewReader(lock))
+	if lErr != nil {
+
+		suite.T().Fatal(lErr)
+	}
+	lReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler := handler{suite.pool, stateHandler}
+
+	handler.ServeHTTP(rr, lReq)
+	assert.Equal(suite.T(), http.StatusOK, rr.Code)
+
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	store.(*MockStore).conflict = true
+
+	// store state
+	state := "{\"test\": \"value4\"}"
+
+	pReq, pErr := http.NewRequest("POST", "/state/sample4?ID=sampleLocked4", strings.NewReader(state))
+	if pErr != nil {
+
+		suite.T().Fatal(pErr)
+	}
+	pReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, pReq)
+	assert.Equal(suite.T(), http.StatusConflict, rr2.Code)
+}
+
+func (suite *ServerTestSuite) TestStoreStateModifiedWhileLocked() {
+
+	// lock state
+	lock := "{\"ID\": \"sampleLocked9\"}"
+	lReq, lErr := http.NewRequest("LOCK", "/state/sample9", strings.NewReader(lock))
+	if lErr != nil {
+
+		suite.T().Fatal(lErr)
+	}
+	lReq.Header.Set("Authorization", suite.auth)
+
+	rr := httptest.NewRecorder()
+	handler := handler{suite.pool, stateHandler}
+
+	handler.ServeHTTP(rr, lReq)
+	assert.Equal(suite.T(), http.StatusOK, rr.Code)
+
+	// store state, expecting it to be missing
+	state := "{\"test\": \"value9\"}"
+
+	pReq, pErr := http.NewRequest("POST", "/state/sample9?ID=sampleLocked9", strings.NewReader(state))
+	if pErr != nil {
+
+		suite.T().Fatal(pErr)
+	}
+	pReq.Header.Set("Authorization", suite.auth)
+
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, pReq)
+	assert.Equal(suite.T(), http.StatusOK, rr2.Code)
+
+	// state modified by another writer, ignoring the lock
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
+
+	assert.Nil(suite.T(), sErr)
+
+	assert.Nil(suite.T(), store.SetBin("sample9", []byte("{\"test\": \"other\"}")))
+
+	// store state again
+	pReq2, pErr2 := http.NewRequest("POST", "/state/sample9?ID=sampleLocked9", strings.NewReader(state))
+	if pErr2 != nil {
+
+		suite.T().Fatal(pErr2)
+	}
+	pReq2.Header.Set("Authorization", suite.auth)
+
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, pReq2)
+	assert.Equal(suite.T(), http.StatusConflict, rr3.Code)
+}
+
 func (suite *ServerTestSuite) TestStoreStateWithoutLocking() {
 
 	// store state
@@ -230,7 +672,7 @@ func (suite *ServerTestSuite) TestUnlockingWrongState() {
 	handler.ServeHTTP(rr, lReq)
 	assert.Equal(suite.T(), http.StatusOK, rr.Code)
 
-	store, sErr := suite.pool.Get(suite.creds)
+	store, sErr := suite.pool.Get(suite.creds, "", nil)
 
 	assert.Nil(suite.T(), sErr)
 
@@ -253,6 +695,35 @@ func (suite *ServerTestSuite) TestUnlockingWrongState() {
 	assert.Equal(suite.T(), http.StatusUnprocessableEntity, rr.Code)
 }
 
+func TestParseRetentionOverrides(t *testing.T) {
+
+	overrides, err := parseRetentionOverrides("prod-*=100, tmp-*=5:7d,team/*=0:12h", true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []vault.RetentionOverride{
+		{Pattern: "prod-*", Retention: vault.Retention{MaxVersions: 100}},
+		{Pattern: "tmp-*", Retention: vault.Retention{MaxVersions: 5, DeleteVersionAfter: 7 * 24 * time.Hour}},
+		{Pattern: "team/*", Retention: vault.Retention{DeleteVersionAfter: 12 * time.Hour}},
+	}, overrides)
+
+	_, err = parseRetentionOverrides("prod-*", true)
+	assert.NotNil(t, err)
+
+	_, err = parseRetentionOverrides("prod-*=many", true)
+	assert.NotNil(t, err)
+
+	_, err = parseRetentionOverrides("prod-*=10:soon", true)
+	assert.NotNil(t, err)
+
+	// the deletion time requires an explicit opt-in
+	overrides, err = parseRetentionOverrides("prod-*=100", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []vault.RetentionOverride{{Pattern: "prod-*", Retention: vault.Retention{MaxVersions: 100}}}, overrides)
+
+	_, err = parseRetentionOverrides("tmp-*=5:7d", false)
+	assert.NotNil(t, err)
+}
+
 func TestServerTestSuite(t *testing.T) {
 
 	suite.Run(t, new(ServerTestSuite))
@@ -262,6 +733,8 @@ func TestServerTestSuite(t *testing.T) {
 
 type MockPool struct {
 	stores map[string]s.Store
+
+	clientCert *x509.Certificate // last client certificate received
 }
 
 func NewMockPool() s.Pool {
@@ -272,7 +745,14 @@ func NewMockPool() s.Pool {
 	return p
 }
 
-func (p *MockPool) Get(identifier string) (val s.Store, err error) {
+func (p *MockPool) Get(identifier, namespace string, clientCert *x509.Certificate) (val s.Store, err error) {
+
+	p.clientCert = clientCert
+
+	if identifier == "invalidID" {
+
+		return nil, &s.UnauthorizedError{Err: errors.New("permission denied")}
+	}
 
 	var ok bool
 	if val, ok = p.stores[identifier]; ok {
@@ -285,40 +765,126 @@ func (p *MockPool) Get(identifier string) (val s.Store, err error) {
 	return
 }
 
-func (p *MockPool) Delete(identifier string) {
+func (p *MockPool) Delete(identifier, namespace string, clientCert *x509.Certificate) {
 
 	delete(p.stores, identifier)
 }
 
 type MockStore struct {
-	data map[string]*[]byte
+	data     map[string][][]byte
+	outdated map[string]bool
+
+	conflict bool
 }
 
 func NewMockStore() s.Store {
 
 	st := &MockStore{}
-	st.data = make(map[string]*[]byte)
+	st.data = make(map[string][][]byte)
+	st.outdated = make(map[string]bool)
 
 	return st
 }
 
 func (st *MockStore) SetBin(name string, data []byte) error {
 
-	st.data[name] = &data
+	if st.conflict {
+
+		return &s.VersionConflictError{}
+	}
+
+	st.data[name] = append(st.data[name], data)
+
+	return nil
+}
+
+func (st *MockStore) SetBinVersion(name string, data []byte, version int) (int, error) {
+
+	if st.conflict || version >= 0 && version != len(st.data[name]) {
+
+		return 0, &s.VersionConflictError{}
+	}
+
+	st.data[name] = append(st.data[name], data)
+
+	return len(st.data[name]), nil
+}
+
+func (st *MockStore) CreateBin(name string, data []byte) error {
+
+	if _, ok := st.data[name]; ok {
+
+		return &s.ItemAlreadyExistsError{}
+	}
+
+	st.data[name] = [][]byte{data}
 
 	return nil
 }
 
 func (st *MockStore) GetBin(name string) (out []byte, err error) {
 
-	if val, ok := st.data[name]; ok {
+	return st.GetBinVersion(name, 0)
+}
 
-		return *val, nil
+func (st *MockStore) GetBinVersion(name string, version int) (out []byte, err error) {
+
+	if versions, ok := st.data[name]; ok {
+
+		if version == 0 {
+
+			return versions[len(versions)-1], nil
+
+		} else if version <= len(versions) {
+
+			return versions[version-1], nil
+		}
 	}
 
 	return nil, &s.ItemNotFoundError{}
 }
 
+func (st *MockStore) Version(name string) (int, error) {
+
+	return len(st.data[name]), nil
+}
+
+func (st *MockStore) Upgrade(name string) (bool, error) {
+
+	versions, ok := st.data[name]
+	if !ok {
+
+		return false, &s.ItemNotFoundError{}
+	}
+
+	if !st.outdated[name] {
+
+		return false, nil
+	}
+
+	delete(st.outdated, name)
+	st.data[name] = append(versions, versions[len(versions)-1])
+
+	return true, nil
+}
+
+func (st *MockStore) Metadata(name string) (*s.Metadata, error) {
+
+	versions, ok := st.data[name]
+	if !ok {
+
+		return nil, &s.ItemNotFoundError{}
+	}
+
+	metadata := &s.Metadata{CurrentVersion: len(versions), OldestVersion: 1, CustomMetadata: map[string]string{}}
+	for version := range versions {
+
+		metadata.Versions = append(metadata.Versions, s.Version{Version: version + 1})
+	}
+
+	return metadata, nil
+}
+
 func (st *MockStore) Delete(name string) error {
 
 	if _, ok := st.data[name]; ok {
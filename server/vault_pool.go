@@ -1,9 +1,17 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	s "github.com/gherynos/vault-backend/store"
 	"github.com/gherynos/vault-backend/vault"
@@ -12,50 +20,197 @@ import (
 
 // VaultPool is an implementation of Pool that manages Vault stores.
 type VaultPool struct {
-	vaultURL, prefix, store string
+	config                vault.Config
+	appRoleMount, certDir string
+	certRoles             map[string]string // Vault role allowed for the client certificates, by subject common name
 
-	stores map[string]*vault.Vault
+	stores map[string]*pooledStore // keyed by poolKey
 	mutex  sync.Mutex
 }
 
+// pooledStore is a Vault store kept in the pool, along with the last time it was retrieved.
+type pooledStore struct {
+	vault    *vault.Vault
+	lastUsed time.Time
+}
+
+// idleTimeout is the time after which the Vault stores not retrieved from the pool are closed and removed.
+var idleTimeout = time.Hour
+
 // NewVaultPool creates a new pool of Vault stores.
-// VaultURL is the URL of the Vault server to connect to.
-// prefix is the string prefix used when storing the secrets in Vault.
-// store the store path used when storing secrets.
-func NewVaultPool(vaultURL, prefix, store string) s.Pool {
+// config contains the settings of the Vault clients, with config.Namespace used as the default namespace.
+// appRoleMount is the path of the AppRole auth method used when the credentials don't specify one.
+// certDir is the directory containing the certificates used to authenticate with a given role,
+// named <role>.crt and <role>.key.
+// certRoles maps the subject common name of the verified client certificates to the role they can authenticate with;
+// the TLS certificates authentication is disabled when empty.
+func NewVaultPool(config vault.Config, appRoleMount, certDir string, certRoles map[string]string) s.Pool {
 
-	vp := &VaultPool{vaultURL: vaultURL, prefix: prefix, store: store}
-	vp.stores = make(map[string]*vault.Vault)
+	vp := &VaultPool{config: config, appRoleMount: appRoleMount, certDir: certDir, certRoles: certRoles}
+	vp.stores = make(map[string]*pooledStore)
 
 	return vp
 }
 
-// Get creates or retrieves a Vault store given an identifier.
-func (vp *VaultPool) Get(identifier string) (val s.Store, err error) {
+// poolKey derives the key used to cache a Vault store from its identifier and namespace,
+// so that credentials like single-use wrapping tokens are not retained in the pool.
+func poolKey(identifier, namespace string) string {
+
+	sum := sha256.Sum256([]byte(namespace + "\n" + identifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// credentialValues is the number of values, including the method, required by the authentication methods.
+var credentialValues = map[string]int{
+	"TOKEN":      2,
+	"APPROLE":    3,
+	"WRAPPED":    3,
+	"KUBERNETES": 3,
+	"JWT":        2,
+	"CERT":       1,
+	"USERPASS":   3,
+	"LDAP":       3,
+}
+
+// parseCredentials decodes the identifier into the authentication method, its mount path and the remaining values.
+// Credentials naming a known method without all the values it requires are rejected,
+// rather than being used as AppRole credentials.
+func (vp *VaultPool) parseCredentials(identifier string) (method, mount string, userPass []string, err error) {
+
+	var dec []byte
+	if dec, err = base64.StdEncoding.DecodeString(identifier); err != nil {
+
+		return
+	}
+
+	userPass = strings.SplitN(string(dec), ":", 3)
+	method, mount, _ = strings.Cut(userPass[0], "@")
+	method = strings.ToUpper(method)
+	if mount == "" {
+
+		mount = strings.ToLower(method)
+		if method == "APPROLE" || method == "WRAPPED" {
+
+			mount = vp.appRoleMount
+		}
+	}
+
+	if values, ok := credentialValues[method]; ok && len(userPass) < values {
+
+		err = &s.UnauthorizedError{Err: fmt.Errorf("missing credentials for the %s auth method", method)}
+	}
+
+	return
+}
+
+// certRole returns the role allowed for the verified client certificate,
+// failing if the TLS certificates authentication is disabled or if the credentials name a different role.
+func (vp *VaultPool) certRole(userPass []string, clientCert *x509.Certificate) (string, error) {
+
+	if len(vp.certRoles) == 0 {
+
+		return "", &s.UnauthorizedError{Err: errors.New("TLS certificates authentication not enabled")}
+	}
+
+	if clientCert == nil {
+
+		return "", &s.UnauthorizedError{Err: errors.New("no verified client certificate")}
+	}
+
+	role, ok := vp.certRoles[clientCert.Subject.CommonName]
+	if !ok {
+
+		return "", &s.UnauthorizedError{Err: fmt.Errorf("no role allowed for %q", clientCert.Subject.CommonName)}
+	}
+
+	if len(userPass) == 3 && userPass[1] != "" && userPass[1] != role {
+
+		return "", &s.UnauthorizedError{Err: fmt.Errorf("role %q not allowed for %q", userPass[1], clientCert.Subject.CommonName)}
+	}
+
+	return role, nil
+}
+
+// storeKey returns the key of the Vault store for the given credentials.
+// Stores authenticated via TLS certificates are keyed on the verified client certificate, as the password is not used.
+func (vp *VaultPool) storeKey(identifier, namespace string, clientCert *x509.Certificate) string {
+
+	if method, mount, _, err := vp.parseCredentials(identifier); err == nil && method == "CERT" && clientCert != nil {
+
+		fingerprint := sha256.Sum256(clientCert.Raw)
+		return poolKey("CERT@"+mount+":"+hex.EncodeToString(fingerprint[:]), namespace)
+	}
+
+	return poolKey(identifier, namespace)
+}
+
+// Get creates or retrieves a Vault store given an identifier, a namespace
+// and the verified client certificate presented by the caller, if any.
+func (vp *VaultPool) Get(identifier, namespace string, clientCert *x509.Certificate) (val s.Store, err error) {
 
 	vp.mutex.Lock()
 	defer vp.mutex.Unlock()
 
-	var ok bool
-	if val, ok = vp.stores[identifier]; ok {
+	method, mount, userPass, err := vp.parseCredentials(identifier)
+	if err != nil {
 
 		return
 	}
 
+	// the role is checked before reusing a store, as it depends on the credentials as well
+	var role string
+	if method == "CERT" {
+
+		if role, err = vp.certRole(userPass, clientCert); err != nil {
+
+			return
+		}
+	}
+
+	vp.evict()
+
+	key := vp.storeKey(identifier, namespace, clientCert)
+	if ps, ok := vp.stores[key]; ok {
+
+		ps.lastUsed = time.Now()
+		return ps.vault, nil
+	}
+
 	log.Debug("Creating a new Vault client...")
 
-	var dec []byte
-	if dec, err = base64.StdEncoding.DecodeString(identifier); err != nil {
+	config := vp.config
+	if namespace != "" {
 
-		return
+		config.Namespace = namespace
 	}
 
-	userPass := strings.Split(string(dec), ":")
 	var vt *vault.Vault
-	if userPass[0] == "TOKEN" {
-		vt, err = vault.NewWithToken(vp.vaultURL, userPass[1], vp.prefix, vp.store)
-	} else {
-		vt, err = vault.NewWithAppRole(vp.vaultURL, userPass[0], userPass[1], vp.prefix, vp.store)
+	switch {
+	case method == "TOKEN":
+		vt, err = vault.NewWithToken(config, strings.Join(userPass[1:], ":"))
+	case method == "APPROLE":
+		vt, err = vault.NewWithAppRole(config, mount, userPass[1], userPass[2])
+	case method == "WRAPPED":
+		vt, err = vault.NewWithWrappedAppRole(config, mount, userPass[1], userPass[2])
+	case method == "KUBERNETES":
+		vt, err = vault.NewWithKubernetes(config, mount, userPass[1], userPass[2])
+	case method == "JWT" && len(userPass) == 3:
+		vt, err = vault.NewWithJWT(config, mount, userPass[1], userPass[2])
+	case method == "JWT":
+		vt, err = vault.NewWithJWT(config, mount, "", strings.Join(userPass[1:], ":"))
+	case method == "CERT":
+		var certFile, keyFile string
+		if certFile, keyFile, err = vp.certFiles(role); err != nil {
+
+			return
+		}
+		vt, err = vault.NewWithCert(config, mount, role, certFile, keyFile)
+	case method == "USERPASS":
+		vt, err = vault.NewWithUserpass(config, mount, userPass[1], userPass[2])
+	case method == "LDAP":
+		vt, err = vault.NewWithLDAP(config, mount, userPass[1], userPass[2])
+	default:
+		vt, err = vault.NewWithAppRole(config, vp.appRoleMount, userPass[0], strings.Join(userPass[1:], ":"))
 	}
 	if err != nil {
 
@@ -63,16 +218,59 @@ func (vp *VaultPool) Get(identifier string) (val s.Store, err error) {
 	}
 
 	val = vt
-	vp.stores[identifier] = vt
+	vp.stores[key] = &pooledStore{vault: vt, lastUsed: time.Now()}
 	return
 }
 
-// Delete removes the Vault store associated with the identifier.
+// evict closes and removes the Vault stores whose token can't be used anymore or that have been idle for too long,
+// and must be called while holding the mutex.
+func (vp *VaultPool) evict() {
+
+	for key, ps := range vp.stores {
+
+		switch {
+		case ps.vault.Expired():
+			log.Debug("Vault token expired, removing client...")
+		case time.Since(ps.lastUsed) > idleTimeout:
+			log.Debug("Vault client idle, removing it...")
+		default:
+			continue
+		}
+
+		ps.vault.Close()
+		delete(vp.stores, key)
+	}
+}
+
+// certFiles returns the certificate and key files associated with role.
+func (vp *VaultPool) certFiles(role string) (certFile, keyFile string, err error) {
+
+	if role == "" || role != filepath.Base(role) || strings.HasPrefix(role, ".") {
+
+		return "", "", &s.UnauthorizedError{Err: fmt.Errorf("invalid role %q", role)}
+	}
+
+	certFile = filepath.Join(vp.certDir, role+".crt")
+	keyFile = filepath.Join(vp.certDir, role+".key")
+	if _, err = os.Stat(certFile); err != nil {
+
+		return "", "", fmt.Errorf("unable to find the certificate of role %q: %w", role, err)
+	}
+
+	return certFile, keyFile, nil
+}
+
+// Delete closes and removes the Vault store associated with the identifier, namespace and client certificate.
 // Invoking delete using a non-existing identifier has no effect.
-func (vp *VaultPool) Delete(identifier string) {
+func (vp *VaultPool) Delete(identifier, namespace string, clientCert *x509.Certificate) {
 
 	vp.mutex.Lock()
 	defer vp.mutex.Unlock()
 
-	delete(vp.stores, identifier)
+	key := vp.storeKey(identifier, namespace, clientCert)
+	if ps, ok := vp.stores[key]; ok {
+
+		ps.vault.Close()
+		delete(vp.stores, key)
+	}
 }
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	s "github.com/gherynos/vault-backend/store"
+	"github.com/gherynos/vault-backend/vault"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCertificate creates a self-signed certificate for commonName,
+// writing it along with its key in dir when not empty.
+func newTestCertificate(t *testing.T, commonName, dir string) *x509.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	if dir != "" {
+
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		assert.Nil(t, err)
+
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, commonName+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, commonName+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	}
+
+	return cert
+}
+
+func certCredentials(username, password string) string {
+
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestCertAuthDisabled(t *testing.T) {
+
+	pool := NewVaultPool(vault.Config{URL: "http://127.0.0.1:1"}, "approle", t.TempDir(), nil)
+	cert := newTestCertificate(t, "ci", "")
+
+	_, err := pool.Get(certCredentials("CERT", "anything"), "", cert)
+
+	var unauthorizedError *s.UnauthorizedError
+	assert.ErrorAs(t, err, &unauthorizedError)
+}
+
+func TestCertAuthRejected(t *testing.T) {
+
+	dir := t.TempDir()
+	pool := NewVaultPool(vault.Config{URL: "http://127.0.0.1:1"}, "approle", dir, map[string]string{"ci": "deploy"})
+	newTestCertificate(t, "deploy", dir)
+
+	var unauthorizedError *s.UnauthorizedError
+
+	// no verified client certificate
+	_, err := pool.Get(certCredentials("CERT", "anything"), "", nil)
+	assert.ErrorAs(t, err, &unauthorizedError)
+
+	// subject without a role
+	_, err = pool.Get(certCredentials("CERT", "anything"), "", newTestCertificate(t, "other", ""))
+	assert.ErrorAs(t, err, &unauthorizedError)
+
+	// role not allowed for the subject
+	_, err = pool.Get(certCredentials("CERT:admin", "anything"), "", newTestCertificate(t, "ci", ""))
+	assert.ErrorAs(t, err, &unauthorizedError)
+}
+
+func TestCertAuth(t *testing.T) {
+
+	var logins []map[string]interface{}
+	var m sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m.Lock()
+		defer m.Unlock()
+
+		if r.URL.Path != "/v1/auth/cert/login" {
+
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		logins = append(logins, body)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "token",
+			"lease_duration": 3600,
+			"renewable":      false,
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	newTestCertificate(t, "deploy", dir)
+	pool := NewVaultPool(vault.Config{URL: srv.URL}, "approle", dir, map[string]string{"ci": "deploy"})
+	cert := newTestCertificate(t, "ci", "")
+
+	store, err := pool.Get(certCredentials("CERT", "first"), "", cert)
+	assert.Nil(t, err)
+	defer pool.Delete(certCredentials("CERT", "first"), "", cert)
+
+	// the store is keyed on the certificate, regardless of the password
+	other, err := pool.Get(certCredentials("CERT:deploy", "second"), "", cert)
+	assert.Nil(t, err)
+	assert.Same(t, store, other)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Len(t, logins, 1)
+	assert.Equal(t, "deploy", logins[0]["name"])
+}
+
+func TestCredentialsDispatch(t *testing.T) {
+
+	var requests []map[string]interface{}
+	var m sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m.Lock()
+		defer m.Unlock()
+
+		request := map[string]interface{}{"path": r.URL.Path, "token": r.Header.Get("X-Vault-Token")}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/auth/token/lookup-self" {
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": 0}})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "token",
+			"lease_duration": 3600,
+			"renewable":      false,
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name, credentials string
+		request           map[string]interface{}
+	}{
+		{"token", "TOKEN:s.abc:def", map[string]interface{}{"path": "/v1/auth/token/lookup-self", "token": "s.abc:def"}},
+		{"approle", "approle:role:secret", map[string]interface{}{"path": "/v1/auth/approle/login", "role_id": "role", "secret_id": "secret"}},
+		{"approle mount", "APPROLE@ci:role:secret", map[string]interface{}{"path": "/v1/auth/ci/login", "role_id": "role", "secret_id": "secret"}},
+		{"kubernetes", "Kubernetes:app:jwt", map[string]interface{}{"path": "/v1/auth/kubernetes/login", "role": "app", "jwt": "jwt"}},
+		{"kubernetes mount", "KUBERNETES@k8s-prod:app:jwt", map[string]interface{}{"path": "/v1/auth/k8s-prod/login", "role": "app", "jwt": "jwt"}},
+		{"jwt", "jwt:header.payload", map[string]interface{}{"path": "/v1/auth/jwt/login", "jwt": "header.payload"}},
+		{"jwt role", "JWT:ci:header.payload", map[string]interface{}{"path": "/v1/auth/jwt/login", "role": "ci", "jwt": "header.payload"}},
+		{"userpass", "USERPASS:alice:pa:ss", map[string]interface{}{"path": "/v1/auth/userpass/login/alice", "password": "pa:ss"}},
+		{"ldap mount", "ldap@corp:bob:secret", map[string]interface{}{"path": "/v1/auth/corp/login/bob", "password": "secret"}},
+		{"approle fallback", "role:sec:ret", map[string]interface{}{"path": "/v1/auth/approle/login", "role_id": "role", "secret_id": "sec:ret"}},
+	}
+	for _, test := range tests {
+
+		t.Run(test.name, func(t *testing.T) {
+
+			pool := NewVaultPool(vault.Config{URL: srv.URL}, "approle", t.TempDir(), nil)
+
+			identifier := base64.StdEncoding.EncodeToString([]byte(test.credentials))
+
+			m.Lock()
+			requests = nil
+			m.Unlock()
+
+			_, err := pool.Get(identifier, "", nil)
+			assert.Nil(t, err)
+			defer pool.Delete(identifier, "", nil)
+
+			m.Lock()
+			defer m.Unlock()
+			assert.Len(t, requests, 1)
+			for field, value := range test.request {
+
+				assert.Equal(t, value, requests[0][field], field)
+			}
+		})
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+
+	pool := NewVaultPool(vault.Config{URL: "http://127.0.0.1:1"}, "approle", t.TempDir(), nil)
+
+	for _, credentials := range []string{"TOKEN", "KUBERNETES:password", "userpass:alice", "LDAP:bob", "APPROLE@ci:secret", "WRAPPED:token", "jwt"} {
+
+		_, err := pool.Get(base64.StdEncoding.EncodeToString([]byte(credentials)), "", nil)
+
+		var unauthorizedError *s.UnauthorizedError
+		assert.ErrorAs(t, err, &unauthorizedError, credentials)
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+
+	var logins int
+	var m sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m.Lock()
+		defer m.Unlock()
+
+		logins++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "token",
+			"lease_duration": 3600,
+			"renewable":      false,
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	defer func(timeout time.Duration) { idleTimeout = timeout }(idleTimeout)
+	idleTimeout = 100 * time.Millisecond
+
+	pool := NewVaultPool(vault.Config{URL: srv.URL}, "approle", t.TempDir(), nil)
+	identifier := base64.StdEncoding.EncodeToString([]byte("role:secret"))
+	defer pool.Delete(identifier, "", nil)
+
+	first, err := pool.Get(identifier, "", nil)
+	assert.Nil(t, err)
+
+	// the store is reused while in use
+	other, err := pool.Get(identifier, "", nil)
+	assert.Nil(t, err)
+	assert.Same(t, first, other)
+
+	// and replaced once idle
+	time.Sleep(200 * time.Millisecond)
+	other, err = pool.Get(identifier, "", nil)
+	assert.Nil(t, err)
+	assert.NotSame(t, first, other)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 2, logins)
+}
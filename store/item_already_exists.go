@@ -0,0 +1,9 @@
+package store
+
+// ItemAlreadyExistsError is an error returned when creating an item that is already present in a Store.
+type ItemAlreadyExistsError struct{}
+
+func (e *ItemAlreadyExistsError) Error() string {
+
+	return "item already exists"
+}
@@ -0,0 +1,22 @@
+package store
+
+import "time"
+
+// Metadata describes the versions of an item in a Store.
+type Metadata struct {
+	CurrentVersion int               `json:"current_version"`
+	OldestVersion  int               `json:"oldest_version"`
+	CreatedTime    time.Time         `json:"created_time"`
+	UpdatedTime    time.Time         `json:"updated_time"`
+	CustomMetadata map[string]string `json:"custom_metadata"`
+	Versions       []Version         `json:"versions"`
+}
+
+// Version describes a single version of an item in a Store.
+// DeletionTime is nil unless the version was deleted.
+type Version struct {
+	Version      int        `json:"version"`
+	CreatedTime  time.Time  `json:"created_time"`
+	DeletionTime *time.Time `json:"deletion_time"`
+	Destroyed    bool       `json:"destroyed"`
+}
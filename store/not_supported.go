@@ -0,0 +1,11 @@
+package store
+
+// NotSupportedError is an error returned when a Store doesn't support the requested operation.
+type NotSupportedError struct {
+	Operation string
+}
+
+func (e *NotSupportedError) Error() string {
+
+	return e.Operation + " not supported"
+}
@@ -1,10 +1,14 @@
 package store
 
+import "crypto/x509"
+
 // Pool is a collection of Stores.
-// The Get method creates a new Store for the given identifier if not already present.
+// The Get method creates a new Store for the given identifier and namespace if not already present,
+// with an empty namespace referring to the default one.
+// clientCert is the verified certificate presented by the caller, or nil if none.
 // Trying to delete a Store via an unknown identifier has no effect.
 type Pool interface {
-	Get(identifier string) (Store, error)
+	Get(identifier, namespace string, clientCert *x509.Certificate) (Store, error)
 
-	Delete(identifier string)
+	Delete(identifier, namespace string, clientCert *x509.Certificate)
 }
@@ -2,10 +2,29 @@ package store
 
 // Store is a collection of byte arrays.
 // The byte arrays can be stored, retrieved and deleted by name.
+// CreateBin atomically stores a byte array only if no other one is present with the same name.
+// SetBinVersion stores a byte array only if its latest version, as returned by Version, is the given one,
+// returning the new version or a VersionConflictError otherwise.
+// GetBinVersion retrieves a previous version of a byte array, starting from 1,
+// and Metadata describes all the versions available.
+// Upgrade rewrites a byte array when it's not stored in the format currently configured,
+// reporting whether it was rewritten.
 type Store interface {
 	SetBin(name string, data []byte) error
 
+	SetBinVersion(name string, data []byte, version int) (int, error)
+
+	CreateBin(name string, data []byte) error
+
 	GetBin(name string) (out []byte, err error)
 
+	GetBinVersion(name string, version int) (out []byte, err error)
+
+	Version(name string) (int, error)
+
+	Metadata(name string) (*Metadata, error)
+
+	Upgrade(name string) (upgraded bool, err error)
+
 	Delete(name string) error
 }
@@ -0,0 +1,16 @@
+package store
+
+// UnauthorizedError is an error returned when the credentials used to access a Store are not valid.
+type UnauthorizedError struct {
+	Err error
+}
+
+func (e *UnauthorizedError) Error() string {
+
+	return "unauthorized: " + e.Err.Error()
+}
+
+func (e *UnauthorizedError) Unwrap() error {
+
+	return e.Err
+}
@@ -0,0 +1,10 @@
+package store
+
+// VersionConflictError is an error returned when an item was modified
+// after the version the update was based on.
+type VersionConflictError struct{}
+
+func (e *VersionConflictError) Error() string {
+
+	return "version conflict"
+}
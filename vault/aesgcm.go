@@ -0,0 +1,157 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// aesGCMPrefix starts the content encrypted with AES-GCM, followed by the key ID and the BASE64-encoded
+// nonce and ciphertext, separated by colons.
+const aesGCMPrefix = "aesgcm:"
+
+// Keyring contains the AES-256 keys used to encrypt the content of the secrets before storing them.
+// Content is encrypted with the Current key, while all the keys can be used to decrypt it,
+// so that the keys can be rotated.
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+// ParseKeyring parses a list of <key_id>:<base64_key> entries separated by commas or new lines,
+// with the first entry being the current key.
+func ParseKeyring(value string) (*Keyring, error) {
+
+	keyring := &Keyring{Keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+
+			return nil, errors.New("invalid key entry, expected <key_id>:<base64_key>")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+
+		if len(key) != 32 {
+
+			return nil, fmt.Errorf("invalid key %s: AES-256 keys must be 32 bytes long", id)
+		}
+
+		if _, ok := keyring.Keys[id]; ok {
+
+			return nil, fmt.Errorf("duplicate key %s", id)
+		}
+
+		if keyring.Current == "" {
+
+			keyring.Current = id
+		}
+		keyring.Keys[id] = key
+	}
+
+	if keyring.Current == "" {
+
+		return nil, errors.New("no keys found")
+	}
+
+	return keyring, nil
+}
+
+// isSealed reports whether value was encrypted with a key of the Keyring.
+func isSealed(value string) bool {
+
+	return strings.HasPrefix(value, aesGCMPrefix)
+}
+
+// sealedKeyID returns the ID of the key used to encrypt value.
+func sealedKeyID(value string) string {
+
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, aesGCMPrefix), ":")
+	return id
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the value of the secret name with the current key of the Keyring,
+// authenticating the name as well, so that the value can't be moved to another secret.
+func (k *Keyring) seal(name, value string) (string, error) {
+
+	gcm, err := newGCM(k.Keys[k.Current])
+	if err != nil {
+
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+
+		return "", err
+	}
+
+	return aesGCMPrefix + k.Current + ":" + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), []byte(name))), nil
+}
+
+// open decrypts the value of the secret name with the key whose ID is embedded in it.
+func (k *Keyring) open(name, value string) (string, error) {
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, aesGCMPrefix), ":")
+	if !ok {
+
+		return "", errors.New("invalid encrypted secret data")
+	}
+
+	key, ok := k.Keys[id]
+	if !ok {
+
+		return "", fmt.Errorf("secret data encrypted with the unknown key %s", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+
+		return "", errors.New("invalid encrypted secret data")
+	}
+
+	opened, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+
+		return "", fmt.Errorf("unable to decrypt secret data with key %s: %w", id, err)
+	}
+
+	return string(opened), nil
+}
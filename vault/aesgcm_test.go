@@ -0,0 +1,70 @@
+package vault
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func TestParseKeyring(t *testing.T) {
+
+	keyring, err := ParseKeyring("k2:" + testKey2 + ",\n k1:" + testKey1 + "\n")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", keyring.Current)
+	assert.Len(t, keyring.Keys, 2)
+
+	_, err = ParseKeyring("")
+	assert.NotNil(t, err)
+
+	_, err = ParseKeyring("k1:" + base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.NotNil(t, err)
+
+	_, err = ParseKeyring("k1:" + testKey1 + ",k1:" + testKey2)
+	assert.NotNil(t, err)
+
+	_, err = ParseKeyring(testKey1)
+	assert.NotNil(t, err)
+}
+
+func TestSealOpen(t *testing.T) {
+
+	old, err := ParseKeyring("k1:" + testKey1)
+	assert.Nil(t, err)
+
+	sealed, err := old.seal("sample", "content")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(sealed, "aesgcm:k1:"))
+	assert.NotContains(t, sealed, "content")
+
+	// rotated keys can still open content sealed with previous ones
+	rotated, err := ParseKeyring("k2:" + testKey2 + ",k1:" + testKey1)
+	assert.Nil(t, err)
+
+	opened, err := rotated.open("sample", sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "content", opened)
+
+	resealed, err := rotated.seal("sample", "content")
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", sealedKeyID(resealed))
+
+	_, err = old.open("sample", resealed)
+	assert.NotNil(t, err)
+
+	// tampered content is rejected
+	tampered := []byte(sealed)
+	tampered[len(tampered)-3] ^= 1
+	_, err = old.open("sample", string(tampered))
+	assert.NotNil(t, err)
+	// content moved to another secret is rejected
+	_, err = old.open("other", sealed)
+	assert.NotNil(t, err)
+}
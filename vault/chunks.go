@@ -0,0 +1,198 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Fields of the manifest secret referencing the chunks of a content.
+const (
+	chunksField        = "chunks"
+	checksumField      = "sha256"
+	chunkVersionsField = "chunk_versions"
+	chunkSetField      = "chunk_set"
+)
+
+// chunkPath returns the path of the secret storing the chunk index of the content name, relative to the store.
+// The chunks are stored under <prefix>.chunks/<name>/, apart from the contents, so that they can't clash with
+// any content name, and within the directory of their set, if any.
+func (v *Vault) chunkPath(name, set string, index int) string {
+
+	if set == "" {
+
+		return fmt.Sprintf("%s.chunks/%s/%d", v.config.Prefix, name, index)
+	}
+
+	return fmt.Sprintf("%s.chunks/%s/%s/%d", v.config.Prefix, name, set, index)
+}
+
+// chunkSet returns the set of the chunks referenced by the manifest, empty with KV version 2.
+func chunkSet(manifest map[string]interface{}) string {
+
+	set, _ := manifest[chunkSetField].(string)
+	return set
+}
+
+// writeChunks splits data in chunks of the configured size, storing each of them in a separate secret,
+// and returns the fields of the manifest referencing them.
+// The manifest must be written after all the chunks, so that readers never see a partially written content.
+// With KV version 2 the manifest references the versions of the chunks,
+// so that previous versions of the content remain readable after the chunks are overwritten.
+// With KV version 1 the chunks are written in a new set, named after the checksum of data,
+// so that the chunks referenced by the current manifest are never overwritten.
+func (v *Vault) writeChunks(name, data string) (manifest map[string]interface{}, err error) {
+
+	checksum := sha256.Sum256([]byte(data))
+	var set string
+	if v.kvVersion == KVv1 {
+
+		set = hex.EncodeToString(checksum[:8])
+	}
+
+	var count int
+	var versions []interface{}
+	for offset := 0; offset < len(data); offset += v.config.ChunkSize {
+
+		chunk := v.chunkPath(name, set, count)
+		if err = v.applyRetention(chunk, name); err != nil {
+
+			return nil, err
+		}
+		var version int64
+		if version, err = v.write(chunk, map[string]interface{}{"value": data[offset:min(offset+v.config.ChunkSize, len(data))]}, -1); err != nil {
+
+			return nil, err
+		}
+		versions = append(versions, version)
+		count++
+	}
+
+	manifest = map[string]interface{}{
+		chunksField:   count,
+		checksumField: hex.EncodeToString(checksum[:]),
+	}
+	if v.kvVersion == KVv2 {
+
+		manifest[chunkVersionsField] = versions
+
+	} else {
+
+		manifest[chunkSetField] = set
+	}
+
+	return manifest, nil
+}
+
+// readChunks reassembles the content referenced by the manifest of the secret name,
+// verifying it against the checksum.
+func (v *Vault) readChunks(name string, manifest map[string]interface{}) (data string, err error) {
+
+	count, ok := toInt64(manifest[chunksField])
+	if !ok {
+
+		return "", errors.New("unable to convert chunks manifest")
+	}
+	versions, _ := manifest[chunkVersionsField].([]interface{})
+
+	var builder strings.Builder
+	for index := 0; index < int(count); index++ {
+
+		var version int64
+		if index < len(versions) {
+
+			version, _ = toInt64(versions[index])
+		}
+
+		var fields map[string]interface{}
+		if fields, _, err = v.read(v.chunkPath(name, chunkSet(manifest), index), version); err != nil {
+
+			return "", fmt.Errorf("unable to read chunk %d of %s: %w", index, name, err)
+		}
+
+		value, ok := fields["value"].(string)
+		if !ok {
+
+			return "", fmt.Errorf("unable to convert chunk %d of %s", index, name)
+		}
+		builder.WriteString(value)
+	}
+
+	data = builder.String()
+	checksum := sha256.Sum256([]byte(data))
+	if hex.EncodeToString(checksum[:]) != manifest[checksumField] {
+
+		return "", fmt.Errorf("checksum mismatch for the chunks of %s", name)
+	}
+
+	return data, nil
+}
+
+// dropChunks removes the chunks referenced by the previous manifest of the content name,
+// once the current one no longer references them.
+// Only KV version 1 needs this, as with KV version 2 the chunks are referenced by the previous versions
+// of the manifest, and they're removed along with the content.
+func (v *Vault) dropChunks(name string, previous, current map[string]interface{}) error {
+
+	count, ok := toInt64(previous[chunksField])
+	if !ok || chunkSet(previous) == chunkSet(current) {
+
+		return nil
+	}
+
+	for index := 0; index < int(count); index++ {
+
+		if err := v.destroy(v.chunkPath(name, chunkSet(previous), index)); err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteChunks removes the chunks referenced by the manifest of the content name, along with all their versions.
+// With KV version 2 the chunks dropped when the content shrunk are removed as well.
+func (v *Vault) deleteChunks(name string, manifest map[string]interface{}) error {
+
+	count, ok := toInt64(manifest[chunksField])
+	if !ok {
+
+		return errors.New("unable to convert chunks manifest")
+	}
+
+	for index := 0; index < int(count); index++ {
+
+		if err := v.destroy(v.chunkPath(name, chunkSet(manifest), index)); err != nil {
+
+			return err
+		}
+	}
+
+	if v.kvVersion != KVv2 {
+
+		return nil
+	}
+
+	for index := int(count); ; index++ {
+
+		chunk := v.chunkPath(name, "", index)
+		metadata, err := v.client.Logical().Read(v.metadataPath(chunk))
+		if err != nil {
+
+			return err
+		}
+
+		if metadata == nil {
+
+			return nil
+		}
+
+		if err := v.destroy(chunk); err != nil {
+
+			return err
+		}
+	}
+}
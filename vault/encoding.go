@@ -2,44 +2,206 @@ package vault
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression algorithm used when encoding data.
+type Codec string
+
+const (
+	// CodecZlib compresses data using ZLIB, the default.
+	CodecZlib Codec = "zlib"
+
+	// CodecGzip compresses data using GZIP.
+	CodecGzip Codec = "gzip"
+
+	// CodecZstd compresses data using Zstandard.
+	CodecZstd Codec = "zstd"
+
+	// CodecNone doesn't compress data.
+	CodecNone Codec = "none"
 )
 
-// Encode compresses data using ZLIB and returns its BASE64 representation.
+// envelopePrefix starts the encoded data, followed by the name of the codec, the hex-encoded SHA-256 checksum
+// of the data and the BASE64-encoded compressed data, separated by colons.
+// The prefix can't be confused with the ones of encrypted content (transitPrefix and aesGCMPrefix),
+// and headerless legacy data contains no colons, so that the way a value was stored is told by its prefix alone.
+const envelopePrefix = "vbk2:"
+
+// ErrChecksumMismatch is returned when decoding data that doesn't match the checksum stored along with it.
+var ErrChecksumMismatch = errors.New("encoded data checksum mismatch")
+
+// ParseCodec returns the Codec with the given name, defaulting to CodecZlib when empty.
+func ParseCodec(name string) (Codec, error) {
+
+	switch codec := Codec(strings.ToLower(name)); codec {
+
+	case "":
+		return CodecZlib, nil
+	case CodecZlib, CodecGzip, CodecZstd, CodecNone:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown codec %s", name)
+	}
+}
+
+// Encode compresses data using ZLIB and returns it wrapped in an envelope, as EncodeWith does.
 func Encode(data []byte) (str string, err error) {
 
+	return EncodeWith(data, CodecZlib)
+}
+
+// EncodeWith compresses data using codec and returns its BASE64 representation,
+// wrapped in an envelope naming the codec and containing the checksum of data (see envelopePrefix).
+func EncodeWith(data []byte, codec Codec) (str string, err error) {
+
 	var buf bytes.Buffer
 
-	encoder := zlib.NewWriter(base64.NewEncoder(base64.StdEncoding, &buf))
+	var encoder io.WriteCloser
+	switch codec {
+
+	case CodecZlib:
+		encoder = zlib.NewWriter(&buf)
+	case CodecGzip:
+		encoder = gzip.NewWriter(&buf)
+	case CodecZstd:
+		if encoder, err = zstd.NewWriter(&buf); err != nil {
+
+			return
+		}
+	case CodecNone:
+		buf.Write(data)
+	default:
+		return "", fmt.Errorf("unknown codec %s", codec)
+	}
 
-	var w int
-	defer encoder.Close()
-	if w, err = encoder.Write(data); err != nil {
+	if encoder != nil {
 
-		return
+		if _, err = encoder.Write(data); err != nil {
 
-	} else if w != len(data) {
+			_ = encoder.Close()
+			return
+		}
 
-		err = errors.New("not all the bytes were encoded")
-		return
+		// closing the encoder writes the remaining data and the trailer
+		if err = encoder.Close(); err != nil {
+
+			return
+		}
 	}
 
-	if err = encoder.Flush(); err != nil {
+	checksum := sha256.Sum256(data)
+	str = envelopePrefix + string(codec) + ":" + hex.EncodeToString(checksum[:]) + ":" + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return
+}
 
-		return
+// isLegacyEncoding reports whether data was encoded without the checksum, by previous versions.
+func isLegacyEncoding(data string) bool {
+
+	return !strings.HasPrefix(data, envelopePrefix)
+}
+
+// encodedCodec returns the Codec used to encode data.
+func encodedCodec(data string) Codec {
+
+	if !strings.HasPrefix(data, envelopePrefix) {
+
+		return CodecZlib
 	}
 
-	str = buf.String()
-	return
+	_, rest, _ := strings.Cut(data, ":")
+	codec, _, _ := strings.Cut(rest, ":")
+	return Codec(codec)
 }
 
 // Decode converts and decompresses the BASE64-encoded data, returning the original byte array.
+// The codec is read from the envelope, and the data is verified against its checksum,
+// returning ErrChecksumMismatch if it was corrupted.
+// Data without the envelope is decompressed using ZLIB, as encoded by previous versions.
 func Decode(data string) (bt []byte, err error) {
 
+	if !strings.HasPrefix(data, envelopePrefix) {
+
+		return decodeLegacy(data)
+	}
+
+	var codec, checksum, encoded, rest string
+	var ok bool
+	if codec, rest, ok = strings.Cut(strings.TrimPrefix(data, envelopePrefix), ":"); ok {
+
+		checksum, encoded, ok = strings.Cut(rest, ":")
+	}
+	if !ok {
+
+		return nil, errors.New("invalid encoded data")
+	}
+
+	if bt, err = decompress(Codec(codec), encoded); err != nil {
+
+		return nil, err
+	}
+
+	sum := sha256.Sum256(bt)
+	if hex.EncodeToString(sum[:]) != checksum {
+
+		return nil, ErrChecksumMismatch
+	}
+
+	return bt, nil
+}
+
+// decompress decodes the BASE64-encoded data and decompresses it using codec,
+// failing if the compressed stream is incomplete.
+func decompress(codec Codec, encoded string) (bt []byte, err error) {
+
+	var compressed []byte
+	if compressed, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+
+		return
+	}
+
+	var decoder io.ReadCloser
+	switch codec {
+
+	case CodecZlib:
+		decoder, err = zlib.NewReader(bytes.NewReader(compressed))
+	case CodecGzip:
+		decoder, err = gzip.NewReader(bytes.NewReader(compressed))
+	case CodecZstd:
+		var zstdDecoder *zstd.Decoder
+		if zstdDecoder, err = zstd.NewReader(bytes.NewReader(compressed)); err == nil {
+
+			decoder = zstdDecoder.IOReadCloser()
+		}
+	case CodecNone:
+		return compressed, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %s", codec)
+	}
+	if err != nil {
+
+		return
+	}
+
+	defer decoder.Close()
+	return io.ReadAll(decoder)
+}
+
+// decodeLegacy decompresses data encoded using ZLIB without the envelope.
+// Previous versions didn't store the end of the ZLIB stream, so the data is read up to the last flush
+// and can't be verified.
+func decodeLegacy(data string) (bt []byte, err error) {
+
 	var decoder io.ReadCloser
 	if decoder, err = zlib.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))); err != nil {
 
@@ -1,7 +1,11 @@
 package vault
 
 import (
+	"bytes"
+	"compress/zlib"
 	"crypto/rand"
+	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,3 +41,89 @@ func TestEncodeDecodeBin(t *testing.T) {
 
 	assert.Equal(t, data, dec)
 }
+
+func TestEncodeDecodeCodecs(t *testing.T) {
+
+	data := []byte(strings.Repeat("This is a test string...", 100))
+
+	for _, codec := range []Codec{CodecZlib, CodecGzip, CodecZstd, CodecNone} {
+
+		enc, err := EncodeWith(data, codec)
+
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(enc, "vbk2:"+string(codec)+":"))
+		assert.Equal(t, codec, encodedCodec(enc))
+
+		dec, err2 := Decode(enc)
+
+		assert.Nil(t, err2)
+
+		assert.Equal(t, data, dec)
+	}
+
+	_, err := EncodeWith(data, Codec("lz4"))
+	assert.NotNil(t, err)
+
+	_, err = Decode("vbk2:lz4:00:AAAA")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeLegacy(t *testing.T) {
+
+	data := []byte("This is a test string...")
+
+	// encoded as by previous versions, without the envelope
+	var buf bytes.Buffer
+	encoder := zlib.NewWriter(base64.NewEncoder(base64.StdEncoding, &buf))
+	_, err := encoder.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.Flush())
+
+	assert.Equal(t, CodecZlib, encodedCodec(buf.String()))
+
+	dec, err2 := Decode(buf.String())
+
+	assert.Nil(t, err2)
+
+	assert.Equal(t, data, dec)
+}
+
+func TestParseCodec(t *testing.T) {
+
+	codec, err := ParseCodec("")
+	assert.Nil(t, err)
+	assert.Equal(t, CodecZlib, codec)
+
+	codec, err = ParseCodec("ZSTD")
+	assert.Nil(t, err)
+	assert.Equal(t, CodecZstd, codec)
+
+	_, err = ParseCodec("lz4")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+
+	data := []byte(strings.Repeat("This is a test string...", 100))
+
+	enc, err := Encode(data)
+	assert.Nil(t, err)
+
+	// truncated stream
+	parts := strings.SplitN(enc, ":", 4)
+	compressed, err := base64.StdEncoding.DecodeString(parts[3])
+	assert.Nil(t, err)
+
+	truncated := strings.Join(parts[:3], ":") + ":" + base64.StdEncoding.EncodeToString(compressed[:len(compressed)-4])
+	_, err = Decode(truncated)
+	assert.NotNil(t, err)
+
+	// altered content
+	enc, err = EncodeWith(data, CodecNone)
+	assert.Nil(t, err)
+
+	parts = strings.SplitN(enc, ":", 4)
+	altered := strings.Join(parts[:3], ":") + ":" + base64.StdEncoding.EncodeToString([]byte("altered"))
+	_, err = Decode(altered)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
@@ -0,0 +1,113 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format is the way the binary content of the secrets is stored.
+type Format string
+
+const (
+	// FormatEncoded stores the content compressed, BASE64-encoded and optionally encrypted, the default.
+	FormatEncoded Format = ""
+
+	// FormatText stores the content as is.
+	FormatText Format = "text"
+
+	// FormatJSON stores the content as the fields of the secret when it's a JSON object, or as FormatText otherwise.
+	FormatJSON Format = "json"
+)
+
+// formatField marks the secrets whose content is stored as FormatText or FormatJSON.
+const formatField = "vbk_format"
+
+// ParseFormat returns the Format with the given name, defaulting to FormatEncoded when empty.
+func ParseFormat(name string) (Format, error) {
+
+	switch format := Format(strings.ToLower(name)); format {
+
+	case FormatEncoded, "encoded":
+		return FormatEncoded, nil
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %s", name)
+	}
+}
+
+// storedFormat returns the Format of the content stored in the fields of a secret.
+func storedFormat(fields map[string]interface{}) Format {
+
+	format, _ := fields[formatField].(string)
+	return Format(format)
+}
+
+// jsonFields decodes data as the fields of a secret, if it's a JSON object.
+// Numbers are kept as they are, so that no precision is lost.
+func jsonFields(data []byte) (fields map[string]interface{}, ok bool) {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+
+		return nil, false
+	}
+
+	// trailing data can't be stored
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+
+		return nil, false
+	}
+
+	if _, ok := fields[formatField]; ok {
+
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// fieldsJSON encodes the fields of a secret stored as FormatJSON back to a JSON object.
+func fieldsJSON(fields map[string]interface{}) ([]byte, error) {
+
+	object := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+
+		if key != formatField {
+
+			object[key] = value
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(object); err != nil {
+
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// plainFields returns the fields storing data as FormatJSON, if configured and possible.
+// Content exceeding the chunk size is stored as FormatText instead, so that it can be split.
+func (v *Vault) plainFields(data []byte) (fields map[string]interface{}, ok bool) {
+
+	if v.config.Format != FormatJSON || (v.config.ChunkSize > 0 && len(data) > v.config.ChunkSize) {
+
+		return nil, false
+	}
+
+	if fields, ok = jsonFields(data); ok {
+
+		fields[formatField] = string(FormatJSON)
+	}
+
+	return
+}
@@ -0,0 +1,44 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormat(t *testing.T) {
+
+	format, err := ParseFormat("")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatEncoded, format)
+
+	format, err = ParseFormat("encoded")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatEncoded, format)
+
+	format, err = ParseFormat("JSON")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatJSON, format)
+
+	_, err = ParseFormat("yaml")
+	assert.NotNil(t, err)
+}
+
+func TestJSONFields(t *testing.T) {
+
+	state := `{"version": 4, "serial": 12345678901234567890, "lineage": "a<b>", "outputs": {"value": 1.50}}`
+
+	fields, ok := jsonFields([]byte(state))
+	assert.True(t, ok)
+
+	// numbers and characters are kept as they are
+	out, err := fieldsJSON(fields)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"lineage":"a<b>","outputs":{"value":1.50},"serial":12345678901234567890,"version":4}`, string(out))
+
+	for _, data := range []string{`[1, 2]`, `"text"`, `null`, `{"a": 1} {"b": 2}`, `{"vbk_format": "json"}`, `not json`} {
+
+		_, ok = jsonFields([]byte(data))
+		assert.False(t, ok, data)
+	}
+}
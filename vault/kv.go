@@ -0,0 +1,248 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	s "github.com/gherynos/vault-backend/store"
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Versions of the KV secrets engine supported by the Vault client.
+const (
+	// KVv1 stores the secrets as plain key/value pairs, overwriting them on every write.
+	// No previous versions of the secrets are kept, and locks are not acquired atomically
+	// since the engine doesn't support check-and-set operations.
+	KVv1 = 1
+
+	// KVv2 stores a new version of the secrets on every write.
+	KVv2 = 2
+)
+
+// kvV1Warning ensures the limitations of KV version 1 are logged only once, rather than for every Vault client.
+var kvV1Warning sync.Once
+
+// WarnKVv1 logs the limitations of KV version 1, once per process.
+func WarnKVv1() {
+
+	kvV1Warning.Do(func() {
+
+		log.Warn("Using KV version 1: previous versions of the states are not kept and locks are not acquired atomically")
+	})
+}
+
+// detectKVVersion looks up the version of the KV secrets engine mounted at the store path,
+// caching the result for the subsequent calls.
+func (v *Vault) detectKVVersion() error {
+
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	if v.kvVersion != 0 {
+
+		return nil
+	}
+
+	log.Debugf("Detecting the KV secrets engine version of %s...", v.config.Store)
+
+	secret, err := v.client.Logical().Read(fmt.Sprintf("sys/internal/ui/mounts/%s", v.config.Store))
+	if err != nil {
+
+		return err
+	}
+
+	if secret == nil {
+
+		return fmt.Errorf("no secrets engine mounted at %s", v.config.Store)
+	}
+
+	// KV version 1 mounts created before Vault 0.10 have type "generic"
+	if mountType, _ := secret.Data["type"].(string); mountType != "kv" && mountType != "generic" {
+
+		return fmt.Errorf("the secrets engine mounted at %s is not a KV one (%s)", v.config.Store, mountType)
+	}
+
+	v.kvVersion = KVv1
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok && options["version"] == "2" {
+
+		v.kvVersion = KVv2
+
+	} else {
+
+		WarnKVv1()
+	}
+
+	return nil
+}
+
+// secretPath returns the path of the secret storing the content name, relative to the store.
+func (v *Vault) secretPath(name string) string {
+
+	return fmt.Sprintf("%s/%s", v.config.Prefix, name)
+}
+
+// dataPath returns the path used to read and write the secret, given its path relative to the store.
+func (v *Vault) dataPath(secret string) string {
+
+	if v.kvVersion == KVv1 {
+
+		return fmt.Sprintf("%s/%s", v.config.Store, secret)
+	}
+
+	return fmt.Sprintf("%s/data/%s", v.config.Store, secret)
+}
+
+// metadataPath returns the path used to remove the secret along with all its versions, given its path relative to the store.
+func (v *Vault) metadataPath(secret string) string {
+
+	if v.kvVersion == KVv1 {
+
+		return fmt.Sprintf("%s/%s", v.config.Store, secret)
+	}
+
+	return fmt.Sprintf("%s/metadata/%s", v.config.Store, secret)
+}
+
+// payload wraps data in the format expected when writing a secret.
+func (v *Vault) payload(data map[string]interface{}) map[string]interface{} {
+
+	if v.kvVersion == KVv1 {
+
+		return data
+	}
+
+	return map[string]interface{}{"data": data}
+}
+
+// secretData extracts the key/value pairs from a secret read from Vault.
+func (v *Vault) secretData(secret *api.Secret) (data map[string]interface{}, ok bool) {
+
+	if v.kvVersion == KVv1 {
+
+		return secret.Data, secret.Data != nil
+	}
+
+	data, ok = secret.Data["data"].(map[string]interface{})
+	return
+}
+
+// toInt64 converts a numeric value returned by Vault.
+func toInt64(value interface{}) (int64, bool) {
+
+	switch number := value.(type) {
+
+	case json.Number:
+		converted, err := number.Int64()
+		return converted, err == nil
+	case int64:
+		return number, true
+	case int:
+		return int64(number), true
+	case float64:
+		return int64(number), true
+	default:
+		return 0, false
+	}
+}
+
+// isCheckAndSetError reports whether err was caused by a check-and-set version mismatch.
+func isCheckAndSetError(err error) bool {
+
+	var responseError *api.ResponseError
+	if !errors.As(err, &responseError) || responseError.StatusCode != http.StatusBadRequest {
+
+		return false
+	}
+
+	for _, e := range responseError.Errors {
+
+		if strings.Contains(e, "check-and-set") {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMetadata converts the metadata of a secret returned by KV version 2.
+func parseMetadata(data map[string]interface{}) (metadata *s.Metadata, err error) {
+
+	metadata = &s.Metadata{CustomMetadata: map[string]string{}}
+
+	current, _ := toInt64(data["current_version"])
+	oldest, _ := toInt64(data["oldest_version"])
+	metadata.CurrentVersion = int(current)
+	metadata.OldestVersion = int(oldest)
+
+	if metadata.CreatedTime, err = parseTime(data["created_time"]); err != nil {
+
+		return nil, err
+	}
+	if metadata.UpdatedTime, err = parseTime(data["updated_time"]); err != nil {
+
+		return nil, err
+	}
+
+	if custom, ok := data["custom_metadata"].(map[string]interface{}); ok {
+
+		for key, value := range custom {
+
+			metadata.CustomMetadata[key] = fmt.Sprint(value)
+		}
+	}
+
+	versions, _ := data["versions"].(map[string]interface{})
+	for key, value := range versions {
+
+		details, ok := value.(map[string]interface{})
+		if !ok {
+
+			return nil, errors.New("unable to convert version metadata")
+		}
+
+		version := s.Version{}
+		if version.Version, err = strconv.Atoi(key); err != nil {
+
+			return nil, err
+		}
+		if version.CreatedTime, err = parseTime(details["created_time"]); err != nil {
+
+			return nil, err
+		}
+		if deletion, _ := details["deletion_time"].(string); deletion != "" {
+
+			var deletionTime time.Time
+			if deletionTime, err = parseTime(deletion); err != nil {
+
+				return nil, err
+			}
+			version.DeletionTime = &deletionTime
+		}
+		version.Destroyed, _ = details["destroyed"].(bool)
+
+		metadata.Versions = append(metadata.Versions, version)
+	}
+
+	sort.Slice(metadata.Versions, func(i, j int) bool {
+
+		return metadata.Versions[i].Version < metadata.Versions[j].Version
+	})
+
+	return metadata, nil
+}
+
+// parseTime converts a timestamp returned by Vault.
+func parseTime(value interface{}) (time.Time, error) {
+
+	str, _ := value.(string)
+	return time.Parse(time.RFC3339Nano, str)
+}
@@ -0,0 +1,144 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVv1Layout(t *testing.T) {
+
+	v := &Vault{config: Config{Prefix: "vbk", Store: "kv"}, kvVersion: KVv1}
+
+	assert.Equal(t, "kv/vbk/sample", v.dataPath(v.secretPath("sample")))
+	assert.Equal(t, "kv/vbk/sample", v.metadataPath(v.secretPath("sample")))
+
+	payload := v.payload(map[string]interface{}{"value": "test"})
+	assert.Equal(t, map[string]interface{}{"value": "test"}, payload)
+
+	data, ok := v.secretData(&api.Secret{Data: payload})
+	assert.True(t, ok)
+	assert.Equal(t, "test", data["value"])
+}
+
+func TestKVv2Layout(t *testing.T) {
+
+	v := &Vault{config: Config{Prefix: "vbk", Store: "secret"}, kvVersion: KVv2}
+
+	assert.Equal(t, "secret/data/vbk/sample", v.dataPath(v.secretPath("sample")))
+	assert.Equal(t, "secret/metadata/vbk/sample", v.metadataPath(v.secretPath("sample")))
+
+	payload := v.payload(map[string]interface{}{"value": "test"})
+	assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{"value": "test"}}, payload)
+
+	data, ok := v.secretData(&api.Secret{Data: payload})
+	assert.True(t, ok)
+	assert.Equal(t, "test", data["value"])
+}
+
+func TestDetectKVVersion(t *testing.T) {
+
+	mounts := map[string]string{
+		"kv1":     `{"data": {"type": "kv", "path": "kv1/", "options": {"version": "1"}}}`,
+		"kv2":     `{"data": {"type": "kv", "path": "kv2/", "options": {"version": "2"}}}`,
+		"generic": `{"data": {"type": "generic", "path": "generic/", "options": null}}`,
+		"transit": `{"data": {"type": "transit", "path": "transit/", "options": null}}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if mount, ok := mounts[strings.TrimPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/")]; ok {
+
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(mount))
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	kvV1Warning = sync.Once{}
+	for store, expected := range map[string]int{"kv1": KVv1, "kv2": KVv2, "generic": KVv1} {
+
+		client, err := newClient(Config{URL: srv.URL})
+		assert.Nil(t, err)
+
+		v := &Vault{config: Config{Store: store}, client: client}
+		assert.Nil(t, v.detectKVVersion())
+		assert.Equal(t, expected, v.kvVersion, store)
+	}
+
+	// falling back to KV version 1 is logged as a warning, once for all the clients
+	if assert.Len(t, hook.AllEntries(), 1) {
+
+		assert.Equal(t, log.WarnLevel, hook.LastEntry().Level)
+	}
+
+	for _, store := range []string{"transit", "missing"} {
+
+		client, err := newClient(Config{URL: srv.URL})
+		assert.Nil(t, err)
+
+		v := &Vault{config: Config{Store: store}, client: client}
+		assert.NotNil(t, v.detectKVVersion(), store)
+	}
+}
+
+func TestIsCheckAndSetError(t *testing.T) {
+
+	assert.True(t, isCheckAndSetError(&api.ResponseError{
+		StatusCode: http.StatusBadRequest,
+		Errors:     []string{"check-and-set parameter did not match the current version"},
+	}))
+
+	assert.False(t, isCheckAndSetError(&api.ResponseError{
+		StatusCode: http.StatusBadRequest,
+		Errors:     []string{"invalid request"},
+	}))
+
+	assert.False(t, isCheckAndSetError(&api.ResponseError{StatusCode: http.StatusForbidden}))
+}
+
+func TestParseMetadata(t *testing.T) {
+
+	var secret api.Secret
+	assert.Nil(t, json.Unmarshal([]byte(`{"data": {
+		"created_time": "2018-03-22T02:24:06.945319214Z",
+		"current_version": 2,
+		"custom_metadata": {"team": "platform"},
+		"oldest_version": 1,
+		"updated_time": "2018-03-22T02:36:43.986212308Z",
+		"versions": {
+			"2": {"created_time": "2018-03-22T02:36:43.986212308Z", "deletion_time": "", "destroyed": false},
+			"1": {"created_time": "2018-03-22T02:24:06.945319214Z", "deletion_time": "2018-03-22T02:30:00Z", "destroyed": true}
+		}
+	}}`), &secret))
+
+	metadata, err := parseMetadata(secret.Data)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, metadata.CurrentVersion)
+	assert.Equal(t, 1, metadata.OldestVersion)
+	assert.Equal(t, "platform", metadata.CustomMetadata["team"])
+	assert.Len(t, metadata.Versions, 2)
+
+	assert.Equal(t, 1, metadata.Versions[0].Version)
+	assert.True(t, metadata.Versions[0].Destroyed)
+	assert.NotNil(t, metadata.Versions[0].DeletionTime)
+
+	assert.Equal(t, 2, metadata.Versions[1].Version)
+	assert.False(t, metadata.Versions[1].Destroyed)
+	assert.Nil(t, metadata.Versions[1].DeletionTime)
+}
@@ -0,0 +1,105 @@
+package vault
+
+import (
+	"path"
+	"time"
+)
+
+// Retention contains the settings limiting the versions kept for a secret, stored in its KV version 2 metadata.
+type Retention struct {
+	// MaxVersions is the number of versions to keep, with zero meaning the default of the mount.
+	MaxVersions int
+
+	// DeleteVersionAfter is the time after which a version gets deleted, with zero meaning never.
+	DeleteVersionAfter time.Duration
+}
+
+// RetentionOverride applies a Retention to the secrets whose name matches Pattern,
+// using the syntax of path.Match (i.e. prod-* or team/*).
+type RetentionOverride struct {
+	Pattern string
+	Retention
+}
+
+// retention returns the Retention configured for the secret name, if any.
+// The first matching override takes precedence over the default.
+func (v *Vault) retention(name string) (retention Retention, ok bool) {
+
+	for _, override := range v.config.RetentionOverrides {
+
+		if matched, _ := path.Match(override.Pattern, name); matched {
+
+			return override.Retention, true
+		}
+	}
+
+	if v.config.Retention != nil {
+
+		return *v.config.Retention, true
+	}
+
+	return Retention{}, false
+}
+
+// applyRetention updates the metadata of the secret with the Retention configured for the content name,
+// when it's first written or when the settings differ from the ones stored in Vault.
+// The settings applied are recorded, so that the metadata is checked once per secret.
+func (v *Vault) applyRetention(secret, name string) error {
+
+	retention, ok := v.retention(name)
+	if !ok || v.kvVersion != KVv2 {
+
+		return nil
+	}
+
+	v.m.Lock()
+	applied, ok := v.retentions[secret]
+	v.m.Unlock()
+	if ok && applied == retention {
+
+		return nil
+	}
+
+	current, err := v.client.Logical().Read(v.metadataPath(secret))
+	if err != nil {
+
+		return err
+	}
+
+	if current == nil || !retention.matches(current.Data) {
+
+		if _, err := v.client.Logical().Write(v.metadataPath(secret), map[string]interface{}{
+			"max_versions":         retention.MaxVersions,
+			"delete_version_after": retention.DeleteVersionAfter.String(),
+		}); err != nil {
+
+			return err
+		}
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	if v.retentions == nil {
+
+		v.retentions = make(map[string]Retention)
+	}
+	v.retentions[secret] = retention
+
+	return nil
+}
+
+// matches reports whether the metadata of a secret already contains the Retention settings.
+func (r Retention) matches(metadata map[string]interface{}) bool {
+
+	maxVersions, ok := toInt64(metadata["max_versions"])
+	if !ok || maxVersions != int64(r.MaxVersions) {
+
+		return false
+	}
+
+	value, _ := metadata["delete_version_after"].(string)
+	deleteVersionAfter, err := time.ParseDuration(value)
+
+	return err == nil && deleteVersionAfter == r.DeleteVersionAfter
+}
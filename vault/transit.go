@@ -0,0 +1,189 @@
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// transitPrefix starts the ciphertexts returned by the Transit secrets engine, followed by the key version.
+const transitPrefix = "vault:v"
+
+// transitKey returns the name of the Transit key, defaulting to the prefix of the secrets.
+func (v *Vault) transitKey() string {
+
+	if v.config.TransitKey != "" {
+
+		return v.config.TransitKey
+	}
+
+	return v.config.Prefix
+}
+
+// isEncrypted reports whether value is a Transit ciphertext.
+func isEncrypted(value string) bool {
+
+	return strings.HasPrefix(value, transitPrefix)
+}
+
+// encrypt encrypts value using the latest version of the Transit key, when a Transit mount is configured.
+func (v *Vault) encrypt(value string) (string, error) {
+
+	if v.config.TransitMount == "" {
+
+		return value, nil
+	}
+
+	if err := v.refreshToken(); err != nil {
+
+		return "", err
+	}
+
+	secret, err := v.client.Logical().Write(fmt.Sprintf("%s/encrypt/%s", v.config.TransitMount, v.transitKey()), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(value)),
+	})
+	if err != nil {
+
+		return "", err
+	}
+
+	if secret != nil {
+
+		if ciphertext, ok := secret.Data["ciphertext"].(string); ok {
+
+			return ciphertext, nil
+		}
+	}
+
+	return "", errors.New("unable to encrypt secret data")
+}
+
+// decrypt decrypts value when it's a Transit ciphertext, returning it unchanged otherwise.
+// Ciphertexts produced with previous versions of the key are decrypted as long as
+// the versions are allowed by the min_decryption_version of the key.
+func (v *Vault) decrypt(value string) (string, error) {
+
+	if !isEncrypted(value) {
+
+		return value, nil
+	}
+
+	if v.config.TransitMount == "" {
+
+		return "", errors.New("secret data encrypted with Transit, but no Transit mount configured")
+	}
+
+	if err := v.refreshToken(); err != nil {
+
+		return "", err
+	}
+
+	secret, err := v.client.Logical().Write(fmt.Sprintf("%s/decrypt/%s", v.config.TransitMount, v.transitKey()), map[string]interface{}{
+		"ciphertext": value,
+	})
+	if err != nil {
+
+		return "", err
+	}
+
+	if secret != nil {
+
+		if plaintext, ok := secret.Data["plaintext"].(string); ok {
+
+			decoded, err := base64.StdEncoding.DecodeString(plaintext)
+			if err != nil {
+
+				return "", err
+			}
+
+			return string(decoded), nil
+		}
+	}
+
+	return "", errors.New("unable to decrypt secret data")
+}
+
+// transitKeyVersion returns the version of the Transit key value was encrypted with.
+func transitKeyVersion(value string) (int64, bool) {
+
+	version, _, ok := strings.Cut(strings.TrimPrefix(value, transitPrefix), ":")
+	if !ok || !isEncrypted(value) {
+
+		return 0, false
+	}
+
+	number, err := strconv.ParseInt(version, 10, 64)
+	return number, err == nil
+}
+
+// latestTransitKeyVersion returns the latest version of the Transit key, used when encrypting.
+func (v *Vault) latestTransitKeyVersion() (int64, error) {
+
+	if err := v.refreshToken(); err != nil {
+
+		return 0, err
+	}
+
+	secret, err := v.client.Logical().Read(fmt.Sprintf("%s/keys/%s", v.config.TransitMount, v.transitKey()))
+	if err != nil {
+
+		return 0, err
+	}
+
+	if secret != nil {
+
+		if version, ok := toInt64(secret.Data["latest_version"]); ok {
+
+			return version, nil
+		}
+	}
+
+	return 0, errors.New("unable to read the latest version of the Transit key")
+}
+
+// isLatestTransitKey reports whether value was encrypted with the latest version of the Transit key.
+func (v *Vault) isLatestTransitKey(value string) (bool, error) {
+
+	version, ok := transitKeyVersion(value)
+	if !ok {
+
+		return false, errors.New("invalid Transit ciphertext")
+	}
+
+	latest, err := v.latestTransitKeyVersion()
+	if err != nil {
+
+		return false, err
+	}
+
+	return version >= latest, nil
+}
+
+// rewrap encrypts value again with the latest version of the Transit key, without exposing the plaintext.
+func (v *Vault) rewrap(value string) (string, error) {
+
+	if err := v.refreshToken(); err != nil {
+
+		return "", err
+	}
+
+	secret, err := v.client.Logical().Write(fmt.Sprintf("%s/rewrap/%s", v.config.TransitMount, v.transitKey()), map[string]interface{}{
+		"ciphertext": value,
+	})
+	if err != nil {
+
+		return "", err
+	}
+
+	if secret != nil {
+
+		if ciphertext, ok := secret.Data["ciphertext"].(string); ok {
+
+			return ciphertext, nil
+		}
+	}
+
+	return "", errors.New("unable to rewrap secret data")
+}
@@ -3,6 +3,8 @@ package vault
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,52 +13,294 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Config contains the settings of a Vault client.
+type Config struct {
+	// URL is the URL of the Vault server to connect to.
+	URL string
+
+	// Namespace is the Vault Enterprise namespace used when authenticating and storing secrets.
+	// An empty value refers to the root namespace.
+	Namespace string
+
+	// Prefix is the string prefix used when storing the secrets in Vault.
+	Prefix string
+
+	// Store is the store path used when storing secrets.
+	Store string
+
+	// KVVersion is the version of the KV secrets engine mounted at Store, either KVv1 or KVv2.
+	// When zero, the version is detected from the mount the first time the secrets are accessed.
+	KVVersion int
+
+	// ChunkSize is the maximum size of the content of a secret, above which the content
+	// gets split across several secrets. When zero, the content is never split.
+	ChunkSize int
+
+	// Retention is the default Retention applied to the secrets written with Set.
+	// When nil, the metadata of the secrets is left unchanged.
+	Retention *Retention
+
+	// RetentionOverrides are the Retention settings applied to the secrets whose name matches a pattern.
+	RetentionOverrides []RetentionOverride
+
+	// TransitMount is the path of the Transit secrets engine used to encrypt the binary content of the secrets.
+	// When empty, the content is stored unencrypted.
+	TransitMount string
+
+	// TransitKey is the name of the Transit key used to encrypt the content, defaulting to Prefix.
+	TransitKey string
+
+	// Keyring contains the AES-256 keys used to encrypt the binary content of the secrets locally.
+	// When nil, the content is not encrypted locally.
+	Keyring *Keyring
+
+	// Format is the way the binary content of the secrets is stored, defaulting to FormatEncoded.
+	// Codec, Keyring and TransitMount only apply to FormatEncoded.
+	Format Format
+
+	// Codec is the compression algorithm used to encode the binary content of the secrets, defaulting to CodecZlib.
+	Codec Codec
+
+	// TLS contains the settings used to verify the Vault server certificate
+	// and to present a client certificate.
+	TLS api.TLSConfig
+}
+
 // Vault is a client to communicate with an instance of Hashicorp's Vault.
 type Vault struct {
-	roleID, secretID, prefix, store string
-	client                          *api.Client
+	config    Config
+	client    *api.Client
+	kvVersion int
+
+	authPath string
+	authData map[string]interface{}
 
+	retentions map[string]Retention // settings applied to the metadata, by secret path
+
+	secret          *api.Secret // latest token obtained via login
 	tokenExpiration time.Time
+	expired         bool // set when the token can't be obtained again
+	closed          chan struct{}
+	closeOnce       sync.Once
 
 	m sync.Mutex
 }
 
+func newClient(config Config) (client *api.Client, err error) {
+
+	apiConfig := &api.Config{Address: config.URL}
+	if err = apiConfig.ConfigureTLS(&config.TLS); err != nil {
+
+		return nil, err
+	}
+
+	if client, err = api.NewClient(apiConfig); err != nil {
+
+		return nil, err
+	}
+
+	// the namespace is set explicitly, overriding the VAULT_NAMESPACE environment variable read by the client
+	client.ClearNamespace()
+	if config.Namespace != "" {
+
+		client.SetNamespace(config.Namespace)
+	}
+
+	return client, nil
+}
+
 // NewWithToken creates a new Vault client using an authentication token.
-// VaultURL is the URL of the Vault server to connect to.
-// prefix is the string prefix used when storing the secrets in Vault.
-// store the store path used when storing secrets.
-func NewWithToken(vaultURL, token, prefix, store string) (out *Vault, err error) {
+// The token is validated upfront, and renewed in the background if renewable.
+// config contains the settings of the Vault client.
+func NewWithToken(config Config, token string) (out *Vault, err error) {
 
 	var v Vault
-	if v.client, err = api.NewClient(&api.Config{Address: vaultURL}); err != nil {
+	if v.client, err = newClient(config); err != nil {
 
 		return nil, err
 	}
 
-	v.prefix = prefix
-	v.store = store
+	v.config = config
+	v.kvVersion = config.KVVersion
+	v.closed = make(chan struct{})
 	v.client.SetToken(token)
 
+	var secret *api.Secret
+	if secret, err = v.client.Auth().Token().LookupSelf(); err != nil {
+
+		var responseError *api.ResponseError
+		if errors.As(err, &responseError) && responseError.StatusCode == http.StatusForbidden {
+
+			return nil, &s.UnauthorizedError{Err: err}
+		}
+
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if ttl, err = secret.TokenTTL(); err != nil {
+
+		return nil, err
+	}
+
+	// tokens without a TTL never expire
+	if ttl > 0 {
+
+		var renewable bool
+		if renewable, err = secret.TokenIsRenewable(); err != nil {
+
+			return nil, err
+		}
+
+		v.tokenExpiration = expiration(time.Now(), ttl)
+		go v.renew(&api.Secret{Auth: &api.SecretAuth{
+			ClientToken:   token,
+			Renewable:     renewable,
+			LeaseDuration: int(ttl.Seconds()),
+		}})
+	}
+
 	return &v, nil
 }
 
 // NewWithAppRole creates a new Vault client using AppRole as the authentication method.
 // The token retrieved using roleID and secretID is automatically refreshed.
-// VaultURL is the URL of the Vault server to connect to.
-// prefix is the string prefix used when storing the secrets in Vault.
-// store the store path used when storing secrets.
-func NewWithAppRole(vaultURL, roleID, secretID, prefix, store string) (out *Vault, err error) {
+// config contains the settings of the Vault client.
+// mount is the path where the AppRole auth method is enabled.
+func NewWithAppRole(config Config, mount, roleID, secretID string) (out *Vault, err error) {
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+}
+
+// NewWithWrappedAppRole creates a new Vault client using AppRole as the authentication method,
+// with the secretID obtained by unwrapping the response-wrapping token wrappingToken.
+// The wrapping token is single-use and it is not retained once unwrapped.
+// config contains the settings of the Vault client.
+// mount is the path where the AppRole auth method is enabled.
+func NewWithWrappedAppRole(config Config, mount, roleID, wrappingToken string) (out *Vault, err error) {
+
+	var client *api.Client
+	if client, err = newClient(config); err != nil {
+
+		return nil, err
+	}
+
+	var secret *api.Secret
+	if secret, err = client.Logical().Unwrap(wrappingToken); err != nil {
+
+		var responseError *api.ResponseError
+		if errors.As(err, &responseError) && responseError.StatusCode < http.StatusInternalServerError {
+
+			return nil, &s.UnauthorizedError{Err: err}
+		}
+
+		return nil, err
+	}
+
+	if secret == nil {
+
+		return nil, &s.UnauthorizedError{Err: errors.New("empty response-wrapped secret")}
+	}
+
+	secretID, ok := secret.Data["secret_id"].(string)
+	if !ok {
+
+		return nil, &s.UnauthorizedError{Err: errors.New("the response-wrapped secret does not contain a secret_id")}
+	}
+
+	return NewWithAppRole(config, mount, roleID, secretID)
+}
+
+// NewWithKubernetes creates a new Vault client using Kubernetes as the authentication method.
+// The token retrieved using role and the service account jwt is automatically refreshed.
+// config contains the settings of the Vault client.
+// mount is the path where the Kubernetes auth method is enabled.
+func NewWithKubernetes(config Config, mount, role, jwt string) (out *Vault, err error) {
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"role": role,
+		"jwt":  jwt,
+	})
+}
+
+// NewWithJWT creates a new Vault client using JWT/OIDC as the authentication method.
+// The token retrieved using role and jwt is automatically refreshed until the jwt itself expires.
+// An empty role makes Vault use the default role configured on the auth method.
+// config contains the settings of the Vault client.
+// mount is the path where the JWT auth method is enabled.
+func NewWithJWT(config Config, mount, role, jwt string) (out *Vault, err error) {
+
+	authData := map[string]interface{}{"jwt": jwt}
+	if role != "" {
+
+		authData["role"] = role
+	}
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login", mount), authData)
+}
+
+// NewWithUserpass creates a new Vault client using Userpass as the authentication method.
+// The token retrieved using username and password is automatically refreshed.
+// config contains the settings of the Vault client.
+// mount is the path where the Userpass auth method is enabled.
+func NewWithUserpass(config Config, mount, username, password string) (out *Vault, err error) {
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login/%s", mount, username), map[string]interface{}{
+		"password": password,
+	})
+}
+
+// NewWithLDAP creates a new Vault client using LDAP as the authentication method.
+// The token retrieved using username and password is automatically refreshed.
+// config contains the settings of the Vault client.
+// mount is the path where the LDAP auth method is enabled.
+func NewWithLDAP(config Config, mount, username, password string) (out *Vault, err error) {
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login/%s", mount, username), map[string]interface{}{
+		"password": password,
+	})
+}
+
+// NewWithCert creates a new Vault client using TLS certificates as the authentication method.
+// The token retrieved presenting the certificate in certFile and keyFile is automatically refreshed.
+// An empty role makes Vault try all the roles matching the certificate.
+// config contains the settings of the Vault client.
+// mount is the path where the TLS certificates auth method is enabled.
+func NewWithCert(config Config, mount, role, certFile, keyFile string) (out *Vault, err error) {
+
+	if certFile == "" || keyFile == "" {
+
+		return nil, errors.New("certificate and key files are required")
+	}
+
+	config.TLS.ClientCert = certFile
+	config.TLS.ClientKey = keyFile
+
+	authData := map[string]interface{}{}
+	if role != "" {
+
+		authData["name"] = role
+	}
+
+	return newWithLogin(config, fmt.Sprintf("auth/%s/login", mount), authData)
+}
+
+func newWithLogin(config Config, authPath string, authData map[string]interface{}) (out *Vault, err error) {
 
 	var v Vault
-	if v.client, err = api.NewClient(&api.Config{Address: vaultURL}); err != nil {
+	if v.client, err = newClient(config); err != nil {
 
 		return nil, err
 	}
 
-	v.roleID = roleID
-	v.secretID = secretID
-	v.prefix = prefix
-	v.store = store
+	v.authPath = authPath
+	v.authData = authData
+	v.config = config
+	v.kvVersion = config.KVVersion
+	v.closed = make(chan struct{})
 
 	if err = v.authenticate(); err != nil {
 
@@ -66,105 +310,530 @@ func NewWithAppRole(vaultURL, roleID, secretID, prefix, store string) (out *Vaul
 	return &v, nil
 }
 
+// authenticate logs in and starts the background renewal of the token, which lasts until the client is closed.
 func (v *Vault) authenticate() (err error) {
 
-	options := map[string]interface{}{
-		"role_id":   v.roleID,
-		"secret_id": v.secretID,
-	}
-
 	var secret *api.Secret
-	if secret, err = v.client.Logical().Write("auth/approle/login", options); err != nil {
+	if secret, err = v.login(); err != nil {
 
 		return err
 	}
 
+	go v.renew(secret)
+
+	return nil
+}
+
+// expiration returns the time after which a token obtained at the given time is considered expired,
+// leaving a margin to use it before its TTL elapses.
+func expiration(from time.Time, ttl time.Duration) time.Time {
+
+	return from.Add(ttl - min(60*time.Second, ttl/10))
+}
+
+// login obtains a new token, and must be called while holding the lock once the client has been created.
+func (v *Vault) login() (secret *api.Secret, err error) {
+
+	if secret, err = v.client.Logical().Write(v.authPath, v.authData); err != nil {
+
+		return nil, err
+	}
+
+	// non-renewable tokens are still valid until their TTL elapses
 	v.client.SetToken(secret.Auth.ClientToken)
-	v.tokenExpiration = time.Now()
-	if secret.Auth.Renewable {
+	v.secret = secret
+	v.tokenExpiration = expiration(time.Now(), time.Duration(secret.Auth.LeaseDuration)*time.Second)
+
+	return secret, nil
+}
+
+// renew keeps the token obtained via login alive in the background,
+// renewing it ahead of its expiration and logging in again once it reaches its max TTL.
+// A single renewal runs for each Vault client, returning when the client is closed;
+// when logging in again fails, the renewal stops and the client is marked as expired, to be replaced.
+func (v *Vault) renew(secret *api.Secret) {
+
+	for {
+		watcher, err := v.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+		if err != nil {
+
+			log.WithError(err).Error("unable to watch Vault token")
+			return
+		}
+		go watcher.Start()
 
-		v.tokenExpiration = v.tokenExpiration.Add(time.Duration(secret.Auth.LeaseDuration-60) * time.Second)
+		if !v.watch(watcher) {
+
+			return
+		}
+
+		// tokens provided by the user can't be obtained again
+		if v.authPath == "" {
+
+			log.Debug("Vault token reached its max TTL")
+
+			v.m.Lock()
+			v.tokenExpiration = time.Now()
+			v.m.Unlock()
+			return
+		}
+
+		next, err := v.relogin(secret)
+		if err != nil {
+
+			log.WithError(err).Error("unable to log in to Vault again, stopping the renewal")
+
+			v.m.Lock()
+			v.expired = true
+			v.m.Unlock()
+			return
+		}
+		secret = next
 	}
+}
 
-	return nil
+// relogin returns the token obtained by refreshToken after previous, if any, or logs in again.
+func (v *Vault) relogin(previous *api.Secret) (*api.Secret, error) {
+
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	if v.secret != previous {
+
+		return v.secret, nil
+	}
+
+	log.Debug("Logging in to Vault again...")
+
+	return v.login()
+}
+
+// watch tracks the renewals performed by watcher,
+// returning false if the Vault client gets closed before the token reaches its max TTL.
+func (v *Vault) watch(watcher *api.LifetimeWatcher) bool {
+
+	defer watcher.Stop()
+
+	for {
+		select {
+
+		case err := <-watcher.DoneCh():
+			if err != nil {
+
+				log.WithError(err).Warn("unable to renew Vault token")
+			}
+			return true
+
+		case renewal := <-watcher.RenewCh():
+			log.Debug("Vault token renewed")
+
+			v.m.Lock()
+			v.tokenExpiration = expiration(renewal.RenewedAt, time.Duration(renewal.Secret.Auth.LeaseDuration)*time.Second)
+			v.m.Unlock()
+
+		case <-v.closed:
+			return false
+		}
+	}
 }
 
 func (v *Vault) refreshToken() error {
 
-	// only refresh the token when using AppRole
-	if v.roleID == "" && v.secretID == "" {
+	// only refresh the token when using a login method
+	if v.authPath == "" {
 
 		return nil
 	}
 
-	// re-authenticate if the token has expired
+	// log in again if the token has expired and the background renewal was not able to do it yet,
+	// leaving the renewal running to pick up the new token
 	v.m.Lock()
+	defer v.m.Unlock()
+
 	if v.tokenExpiration.Before(time.Now()) {
 
 		log.Debug("Refreshing Vault token...")
 
-		if err := v.authenticate(); err != nil {
+		if _, err := v.login(); err != nil {
 
-			v.m.Unlock()
 			return err
 		}
 	}
-	v.m.Unlock()
 
 	return nil
 }
 
-// Set populates a Vault secret content.
-func (v *Vault) Set(name, data string) error {
+// Expired reports whether the token provided by the user has reached its max TTL,
+// or the background renewal failed to log in again, in which case the Vault client can't be used anymore.
+func (v *Vault) Expired() bool {
+
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	return v.expired || v.authPath == "" && !v.tokenExpiration.IsZero() && v.tokenExpiration.Before(time.Now())
+}
+
+// prepare makes the Vault client ready to access the secrets,
+// refreshing the token and detecting the version of the KV secrets engine if needed.
+func (v *Vault) prepare() error {
 
 	if err := v.refreshToken(); err != nil {
 
 		return err
 	}
 
-	if _, err := v.client.Logical().Write(fmt.Sprintf("%s/data/%s/%s", v.store, v.prefix, name),
-		map[string]interface{}{"data": map[string]interface{}{"value": data}}); err != nil {
+	return v.detectKVVersion()
+}
 
-		return err
+// Close stops the background renewal of the Vault token.
+// The Vault client must not be used after being closed.
+func (v *Vault) Close() {
+
+	v.closeOnce.Do(func() { close(v.closed) })
+}
+
+// Set populates a Vault secret content.
+// Content larger than the chunk size set in the Config is split across several secrets.
+// With KV version 2, the Retention configured for the secret is applied to its metadata.
+func (v *Vault) Set(name, data string) error {
+
+	_, err := v.set(name, data, FormatEncoded, -1)
+	return err
+}
+
+// set stores data in the secret name, marked with format unless FormatEncoded,
+// using check-and-set with version unless negative, and returns the version written.
+func (v *Vault) set(name, data string, format Format, version int64) (int64, error) {
+
+	if err := v.prepare(); err != nil {
+
+		return 0, err
 	}
 
-	return nil
+	fields := map[string]interface{}{"value": data}
+	if v.config.ChunkSize > 0 && len(data) > v.config.ChunkSize {
+
+		var err error
+		if fields, err = v.writeChunks(name, data); err != nil {
+
+			return 0, err
+		}
+	}
+
+	if format != FormatEncoded {
+
+		fields[formatField] = string(format)
+	}
+
+	return v.setFields(name, fields, version)
+}
+
+// setFields stores the fields in the secret name, using check-and-set with version unless negative,
+// and returns the version written.
+// With KV version 1, the chunks referenced by the previous fields are dropped once they're replaced.
+func (v *Vault) setFields(name string, fields map[string]interface{}, version int64) (int64, error) {
+
+	if err := v.prepare(); err != nil {
+
+		return 0, err
+	}
+
+	secret := v.secretPath(name)
+	if err := v.applyRetention(secret, name); err != nil {
+
+		return 0, err
+	}
+
+	var previous map[string]interface{}
+	if v.config.ChunkSize > 0 && v.kvVersion == KVv1 {
+
+		var err error
+		var itemNotFoundError *s.ItemNotFoundError
+		if previous, _, err = v.read(secret, 0); err != nil && !errors.As(err, &itemNotFoundError) {
+
+			return 0, err
+		}
+	}
+
+	written, err := v.write(secret, fields, version)
+	if err != nil {
+
+		return 0, err
+	}
+
+	if previous != nil {
+
+		return written, v.dropChunks(name, previous, fields)
+	}
+
+	return written, nil
 }
 
 // SetBin populates a Vault secret content using binary data.
-func (v *Vault) SetBin(name string, data []byte) (err error) {
+// When a Keyring or a Transit mount are set in the Config, the encoded content is encrypted before being stored.
+// With FormatText or FormatJSON set in the Config, the content is stored as is, or as the fields of the secret.
+func (v *Vault) SetBin(name string, data []byte) error {
 
-	var value string
-	if value, err = Encode(data); err != nil {
+	_, err := v.setBin(name, data, -1)
+	return err
+}
+
+// SetBinVersion populates a Vault secret content using binary data, like SetBin,
+// only if its latest version is the given one, and returns the version written.
+// With KV version 2, the secret is written using check-and-set unless version is negative,
+// returning a VersionConflictError if it was modified in the meantime;
+// with KV version 1 the version is ignored, and the one returned is negative.
+func (v *Vault) SetBinVersion(name string, data []byte, version int) (int, error) {
+
+	written, err := v.setBin(name, data, int64(version))
+	return int(written), err
+}
+
+// setBin stores the binary data in the secret name, using check-and-set with version unless negative.
+func (v *Vault) setBin(name string, data []byte, version int64) (int64, error) {
+
+	if v.config.Format == FormatEncoded {
+
+		value, err := v.encode(name, data)
+		if err != nil {
+
+			return 0, err
+		}
+
+		return v.set(name, value, FormatEncoded, version)
+	}
+
+	if fields, ok := v.plainFields(data); ok {
+
+		return v.setFields(name, fields, version)
+	}
+
+	return v.set(name, string(data), FormatText, version)
+}
+
+// encode encodes the data of the secret name and encrypts it with the Keyring and Transit, when configured.
+func (v *Vault) encode(name string, data []byte) (value string, err error) {
+
+	if value, err = EncodeWith(data, v.codec()); err != nil {
 
 		return
 	}
 
-	return v.Set(name, value)
+	if v.config.Keyring != nil {
+
+		if value, err = v.config.Keyring.seal(name, value); err != nil {
+
+			return
+		}
+	}
+
+	return v.encrypt(value)
+}
+
+// decode decrypts and decodes the value of the secret name, accepting content that was not encrypted.
+func (v *Vault) decode(name, value string) (data []byte, err error) {
+
+	if value, err = v.decrypt(value); err != nil {
+
+		return
+	}
+
+	if value, err = v.open(name, value); err != nil {
+
+		return
+	}
+
+	return Decode(value)
+}
+
+// open decrypts value with the Keyring when it was encrypted locally, returning it unchanged otherwise.
+func (v *Vault) open(name, value string) (string, error) {
+
+	if !isSealed(value) {
+
+		return value, nil
+	}
+
+	if v.config.Keyring == nil {
+
+		return "", errors.New("secret data encrypted locally, but no keys configured")
+	}
+
+	return v.config.Keyring.open(name, value)
+}
+
+// codec returns the Codec used to encode the content, defaulting to CodecZlib.
+func (v *Vault) codec() Codec {
+
+	if v.config.Codec == "" {
+
+		return CodecZlib
+	}
+
+	return v.config.Codec
+}
+
+// Create populates a Vault secret content only if the secret doesn't exist,
+// returning an ItemAlreadyExistsError otherwise.
+// With KV version 2, a secret whose latest version is deleted or destroyed doesn't exist.
+// With KV version 1 the check is not atomic, as the engine doesn't support check-and-set.
+func (v *Vault) Create(name, data string) error {
+
+	return v.createFields(name, map[string]interface{}{"value": data})
+}
+
+// createFields stores the fields in the secret name only if the secret doesn't exist.
+func (v *Vault) createFields(name string, fields map[string]interface{}) error {
+
+	if err := v.prepare(); err != nil {
+
+		return err
+	}
+
+	if v.kvVersion == KVv1 {
+
+		if secret, err := v.client.Logical().Read(v.dataPath(v.secretPath(name))); err != nil {
+
+			return err
+
+		} else if secret != nil {
+
+			return &s.ItemAlreadyExistsError{}
+		}
+	}
+
+	secret := v.secretPath(name)
+	_, err := v.write(secret, fields, 0)
+
+	var versionConflictError *s.VersionConflictError
+	if !errors.As(err, &versionConflictError) {
+
+		return err
+	}
+
+	// the latest version may have been deleted or destroyed, in which case it's overwritten
+	// using check-and-set with its version, so that the creation remains atomic
+	var current int64
+	var itemNotFoundError *s.ItemNotFoundError
+	if _, current, err = v.read(secret, 0); err == nil {
+
+		return &s.ItemAlreadyExistsError{}
+
+	} else if !errors.As(err, &itemNotFoundError) {
+
+		return err
+	}
+
+	if _, err = v.write(secret, fields, current); errors.As(err, &versionConflictError) {
+
+		return &s.ItemAlreadyExistsError{}
+	}
+
+	return err
+}
+
+// CreateBin populates a Vault secret content using binary data, only if the secret doesn't exist.
+func (v *Vault) CreateBin(name string, data []byte) (err error) {
+
+	if v.config.Format == FormatEncoded {
+
+		var value string
+		if value, err = v.encode(name, data); err != nil {
+
+			return
+		}
+
+		return v.Create(name, value)
+	}
+
+	if fields, ok := v.plainFields(data); ok {
+
+		return v.createFields(name, fields)
+	}
+
+	return v.createFields(name, map[string]interface{}{"value": string(data), formatField: string(FormatText)})
+}
+
+// write stores the fields in the secret, using check-and-set with version unless negative,
+// and returns the version written, negative with KV version 1.
+func (v *Vault) write(secret string, fields map[string]interface{}, version int64) (int64, error) {
+
+	payload := v.payload(fields)
+	if version >= 0 && v.kvVersion == KVv2 {
+
+		payload["options"] = map[string]interface{}{"cas": version}
+	}
+
+	response, err := v.client.Logical().Write(v.dataPath(secret), payload)
+	if err != nil {
+
+		if isCheckAndSetError(err) {
+
+			return 0, &s.VersionConflictError{}
+		}
+
+		return 0, err
+	}
+
+	if response != nil {
+
+		if written, ok := toInt64(response.Data["version"]); ok {
+
+			return written, nil
+		}
+	}
+
+	return -1, nil
 }
 
 // Get retrieves the content of a Vault secret.
+// Content split across several secrets is reassembled and verified against its checksum.
 func (v *Vault) Get(name string) (out string, err error) {
 
-	if err = v.refreshToken(); err != nil {
+	return v.GetVersion(name, 0)
+}
+
+// GetVersion retrieves the content of the given version of a Vault secret, or of the latest one if version is zero.
+// Reading a previous version requires KV version 2, otherwise a NotSupportedError is returned.
+func (v *Vault) GetVersion(name string, version int) (out string, err error) {
+
+	var fields map[string]interface{}
+	if fields, _, err = v.readVersion(name, version); err != nil {
 
 		return
 	}
 
-	var secret *api.Secret
-	if secret, err = v.client.Logical().Read(fmt.Sprintf("%s/data/%s/%s", v.store, v.prefix, name)); err != nil {
+	return v.fieldsValue(name, fields)
+}
+
+// readVersion retrieves the fields of the given version of the secret name, or of the latest one if version is zero,
+// along with the version read.
+func (v *Vault) readVersion(name string, version int) (fields map[string]interface{}, current int64, err error) {
+
+	if err = v.prepare(); err != nil {
 
 		return
 	}
 
-	if secret == nil {
+	if version > 0 && v.kvVersion != KVv2 {
+
+		return nil, 0, &s.NotSupportedError{Operation: "reading previous versions with KV version 1"}
+	}
+
+	return v.read(v.secretPath(name), int64(version))
+}
+
+// fieldsValue returns the content stored in the fields of the secret name, reassembling its chunks if needed.
+func (v *Vault) fieldsValue(name string, fields map[string]interface{}) (string, error) {
 
-		return "", &s.ItemNotFoundError{}
+	if _, ok := fields[chunksField]; ok {
+
+		return v.readChunks(name, fields)
 	}
 
-	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+	if value, ok := fields["value"].(string); ok {
 
-		return data["value"].(string), nil
+		return value, nil
 	}
 
 	return "", errors.New("unable to convert secret data")
@@ -173,27 +842,335 @@ func (v *Vault) Get(name string) (out string, err error) {
 // GetBin retrieves the binary content of a Vault secret.
 func (v *Vault) GetBin(name string) (out []byte, err error) {
 
+	return v.GetBinVersion(name, 0)
+}
+
+// GetBinVersion retrieves the binary content of the given version of a Vault secret.
+// Encrypted content is decrypted, while unencrypted content is returned as is.
+// The content is read according to the Format it was stored with, regardless of the one set in the Config.
+func (v *Vault) GetBinVersion(name string, version int) (out []byte, err error) {
+
+	var fields map[string]interface{}
+	if fields, _, err = v.readVersion(name, version); err != nil {
+
+		return
+	}
+
+	return v.fieldsData(name, fields)
+}
+
+// fieldsData returns the binary content stored in the fields of the secret name, according to their Format.
+func (v *Vault) fieldsData(name string, fields map[string]interface{}) ([]byte, error) {
+
+	if storedFormat(fields) == FormatJSON {
+
+		return fieldsJSON(fields)
+	}
+
+	value, err := v.fieldsValue(name, fields)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if storedFormat(fields) == FormatText {
+
+		return []byte(value), nil
+	}
+
+	return v.decode(name, value)
+}
+
+// Upgrade rewrites the binary content of a Vault secret when it's not stored as configured,
+// i.e. when it's unencrypted, encrypted with a previous key of the Keyring or a previous version of the Transit key
+// (rewrapped by Transit when that's the only change), encoded with a different Codec
+// or without a checksum, or stored in a different Format, reporting whether it was rewritten.
+// The content is written as a new version, using check-and-set with the version read.
+func (v *Vault) Upgrade(name string) (upgraded bool, err error) {
+
+	var fields map[string]interface{}
+	var version int64
+	if fields, version, err = v.readVersion(name, 0); err != nil {
+
+		return
+	}
+
+	var current bool
+	if current, err = v.isCurrent(name, fields); err != nil || current {
+
+		return
+	}
+
+	// content only encrypted with a previous version of the Transit key is rewrapped, without being decrypted
 	var value string
-	if value, err = v.Get(name); err != nil {
+	var rewrap bool
+	if value, rewrap, err = v.rewrapValue(name, fields); err != nil {
 
 		return
 	}
+	if rewrap {
 
-	return Decode(value)
+		if _, err = v.set(name, value, FormatEncoded, version); err != nil {
+
+			return
+		}
+
+		return true, nil
+	}
+
+	var data []byte
+	if data, err = v.fieldsData(name, fields); err != nil {
+
+		return
+	}
+
+	if _, err = v.setBin(name, data, version); err != nil {
+
+		return
+	}
+
+	return true, nil
+}
+
+// isCurrent reports whether the content stored in the fields of the secret name is stored as configured.
+func (v *Vault) isCurrent(name string, fields map[string]interface{}) (bool, error) {
+
+	format := storedFormat(fields)
+	if format != FormatEncoded || v.config.Format != FormatEncoded {
+
+		if format == FormatEncoded || v.config.Format == FormatEncoded {
+
+			return false, nil
+		}
+
+		// the content is stored as JSON fields whenever possible
+		data, err := v.fieldsData(name, fields)
+		if err != nil {
+
+			return false, err
+		}
+
+		_, asJSON := v.plainFields(data)
+		return asJSON == (format == FormatJSON), nil
+	}
+
+	value, err := v.fieldsValue(name, fields)
+	if err != nil {
+
+		return false, err
+	}
+
+	if v.config.TransitMount != "" {
+
+		if !isEncrypted(value) {
+
+			return false, nil
+		}
+
+		if latest, err := v.isLatestTransitKey(value); err != nil || !latest {
+
+			return false, err
+		}
+	}
+
+	if value, err = v.decrypt(value); err != nil {
+
+		return false, err
+	}
+
+	return v.isCurrentEncoding(name, value)
 }
 
-// Delete removes a secret from Vault.
+// isCurrentEncoding reports whether value, once decrypted with Transit, is encrypted and encoded as configured.
+func (v *Vault) isCurrentEncoding(name, value string) (bool, error) {
+
+	if v.config.Keyring != nil && (!isSealed(value) || sealedKeyID(value) != v.config.Keyring.Current) {
+
+		return false, nil
+	}
+
+	value, err := v.open(name, value)
+	if err != nil {
+
+		return false, err
+	}
+
+	return !isLegacyEncoding(value) && encodedCodec(value) == v.codec(), nil
+}
+
+// rewrapValue returns the content stored in the fields of the secret name rewrapped with the latest version
+// of the Transit key, when that's the only change needed to store it as configured.
+func (v *Vault) rewrapValue(name string, fields map[string]interface{}) (value string, ok bool, err error) {
+
+	if v.config.TransitMount == "" || v.config.Format != FormatEncoded || storedFormat(fields) != FormatEncoded {
+
+		return "", false, nil
+	}
+
+	if value, err = v.fieldsValue(name, fields); err != nil || !isEncrypted(value) {
+
+		return "", false, err
+	}
+
+	var decrypted string
+	if decrypted, err = v.decrypt(value); err != nil {
+
+		return "", false, err
+	}
+
+	if ok, err = v.isCurrentEncoding(name, decrypted); err != nil || !ok {
+
+		return "", false, err
+	}
+
+	if value, err = v.rewrap(value); err != nil {
+
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// read retrieves the fields of the given version of the secret, or of the latest one if version is zero,
+// along with the version read: zero when the secret doesn't exist, and negative with KV version 1.
+// The version is returned for deleted and destroyed versions as well, so that they can be overwritten.
+func (v *Vault) read(secret string, version int64) (fields map[string]interface{}, current int64, err error) {
+
+	var response *api.Secret
+	if version > 0 && v.kvVersion == KVv2 {
+
+		response, err = v.client.Logical().ReadWithData(v.dataPath(secret), map[string][]string{"version": {strconv.FormatInt(version, 10)}})
+
+	} else {
+
+		response, err = v.client.Logical().Read(v.dataPath(secret))
+	}
+	if err != nil {
+
+		return
+	}
+
+	if response == nil {
+
+		return nil, 0, &s.ItemNotFoundError{}
+	}
+
+	current = -1
+	if metadata, ok := response.Data["metadata"].(map[string]interface{}); ok {
+
+		current, _ = toInt64(metadata["version"])
+	}
+
+	if data, ok := v.secretData(response); ok {
+
+		return data, current, nil
+	}
+
+	// deleted and destroyed versions have no data
+	if response.Data["data"] == nil {
+
+		return nil, current, &s.ItemNotFoundError{}
+	}
+
+	return nil, current, errors.New("unable to convert secret data")
+}
+
+// Version returns the latest version of a Vault secret, deleted and destroyed ones included,
+// or zero if the secret doesn't exist.
+// With KV version 1 the secrets have no versions, and the version returned is negative.
+func (v *Vault) Version(name string) (int, error) {
+
+	if err := v.prepare(); err != nil {
+
+		return 0, err
+	}
+
+	if v.kvVersion != KVv2 {
+
+		return -1, nil
+	}
+
+	_, current, err := v.read(v.secretPath(name), 0)
+
+	var itemNotFoundError *s.ItemNotFoundError
+	if err != nil && !errors.As(err, &itemNotFoundError) {
+
+		return 0, err
+	}
+
+	return int(current), nil
+}
+
+// Metadata retrieves the metadata of a Vault secret, describing all its versions.
+// Metadata requires KV version 2, otherwise a NotSupportedError is returned.
+func (v *Vault) Metadata(name string) (out *s.Metadata, err error) {
+
+	if err = v.prepare(); err != nil {
+
+		return
+	}
+
+	if v.kvVersion != KVv2 {
+
+		return nil, &s.NotSupportedError{Operation: "reading metadata with KV version 1"}
+	}
+
+	var secret *api.Secret
+	if secret, err = v.client.Logical().Read(v.metadataPath(v.secretPath(name))); err != nil {
+
+		return
+	}
+
+	if secret == nil {
+
+		return nil, &s.ItemNotFoundError{}
+	}
+
+	return parseMetadata(secret.Data)
+}
+
+// Delete removes a secret from Vault, along with the chunks referenced by its latest version.
 func (v *Vault) Delete(name string) error {
 
-	if err := v.refreshToken(); err != nil {
+	if err := v.prepare(); err != nil {
 
 		return err
 	}
 
-	if _, err := v.client.Logical().Delete(fmt.Sprintf("%s/metadata/%s/%s", v.store, v.prefix, name)); err != nil {
+	secret := v.secretPath(name)
+	fields, _, err := v.read(secret, 0)
+	if err != nil {
+
+		var itemNotFoundError *s.ItemNotFoundError
+		if !errors.As(err, &itemNotFoundError) {
+
+			return err
+		}
+	}
+
+	// the manifest is removed last, so that the chunks remain referenced if their removal fails
+	if _, ok := fields[chunksField]; ok {
+
+		if err := v.deleteChunks(name, fields); err != nil {
+
+			return err
+		}
+	}
+
+	return v.destroy(secret)
+}
+
+// destroy removes the secret along with all its versions.
+func (v *Vault) destroy(secret string) error {
+
+	if _, err := v.client.Logical().Delete(v.metadataPath(secret)); err != nil {
 
 		return err
 	}
 
+	v.m.Lock()
+	delete(v.retentions, secret)
+	v.m.Unlock()
+
 	return nil
 }
@@ -0,0 +1,819 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	s "github.com/gherynos/vault-backend/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockKV is a minimal in-memory implementation of a KV version 2 secrets engine mounted at secret/.
+type mockKV struct {
+	secrets  map[string][]map[string]interface{}
+	metadata map[string]map[string]interface{}
+	keys     map[string]int // latest version of the Transit keys
+	m        sync.Mutex
+
+	metadataWrites int
+	rewraps        int
+	failing        string // suffix of the paths of the KV version 1 secrets that can't be written
+}
+
+func newMockKV() *mockKV {
+
+	return &mockKV{
+		secrets:  make(map[string][]map[string]interface{}),
+		metadata: make(map[string]map[string]interface{}),
+		keys:     make(map[string]int),
+	}
+}
+
+func (kv *mockKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	kv.m.Lock()
+	defer kv.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		versions := kv.secrets[name]
+
+		switch r.Method {
+
+		case http.MethodGet:
+			version := len(versions)
+			if param := r.URL.Query().Get("version"); param != "" {
+
+				version, _ = strconv.Atoi(param)
+			}
+			if version == 0 || version > len(versions) {
+
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			// deleted versions are returned without data, along with their metadata
+			if versions[version-1] == nil {
+
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+					"data":     nil,
+					"metadata": map[string]interface{}{"version": version, "deletion_time": time.Now().Format(time.RFC3339)},
+				}})
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     versions[version-1],
+				"metadata": map[string]interface{}{"version": version},
+			}})
+
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Data    map[string]interface{} `json:"data"`
+				Options map[string]interface{} `json:"options"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if cas, ok := body.Options["cas"].(float64); ok && int(cas) != len(versions) {
+
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors": ["check-and-set parameter did not match the current version"]}`))
+				return
+			}
+
+			kv.secrets[name] = append(versions, body.Data)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": len(versions) + 1}})
+
+		case http.MethodDelete:
+			if len(versions) > 0 {
+
+				versions[len(versions)-1] = nil
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+
+		switch r.Method {
+
+		case http.MethodGet:
+			metadata, ok := kv.metadata[name]
+			if _, exists := kv.secrets[name]; !ok && !exists {
+
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !ok {
+
+				metadata = map[string]interface{}{"current_version": len(kv.secrets[name])}
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": metadata})
+
+		case http.MethodPut, http.MethodPost:
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			kv.metadata[name] = body
+			kv.metadataWrites++
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			delete(kv.secrets, name)
+			delete(kv.metadata, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	// KV version 1 is mounted at kv/, keeping the latest version only
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+		switch r.Method {
+
+		case http.MethodGet:
+			versions, ok := kv.secrets[name]
+			if !ok {
+
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": versions[0]})
+
+		case http.MethodPut, http.MethodPost:
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if kv.failing != "" && strings.HasSuffix(name, kv.failing) {
+
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			kv.secrets[name] = []map[string]interface{}{body}
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			delete(kv.secrets, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	// the mock Transit engine doesn't encrypt, but tags the plaintext with the key version
+	case strings.HasPrefix(r.URL.Path, "/v1/transit/encrypt/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/transit/encrypt/")
+		if kv.keys[key] == 0 {
+
+			kv.keys[key] = 1
+		}
+
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"ciphertext": fmt.Sprintf("vault:v%d:%s", kv.keys[key], body["plaintext"]),
+		}})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/transit/decrypt/"):
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		parts := strings.SplitN(body["ciphertext"], ":", 3)
+		if len(parts) != 3 {
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"plaintext": parts[2]}})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/transit/rewrap/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/transit/rewrap/")
+
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		parts := strings.SplitN(body["ciphertext"], ":", 3)
+		if len(parts) != 3 {
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		kv.rewraps++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"ciphertext": fmt.Sprintf("vault:v%d:%s", kv.keys[key], parts[2]),
+		}})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/transit/keys/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/transit/keys/")
+		if kv.keys[key] == 0 {
+
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"latest_version": kv.keys[key]}})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestVault(t *testing.T, kv *mockKV, config Config) *Vault {
+
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+
+	config.URL = srv.URL
+	config.Prefix = "vbk"
+	config.Store = "secret"
+	config.KVVersion = KVv2
+
+	client, err := newClient(config)
+	assert.Nil(t, err)
+
+	return &Vault{config: config, client: client, kvVersion: config.KVVersion}
+}
+
+func TestSetGet(t *testing.T) {
+
+	v := newTestVault(t, newMockKV(), Config{})
+
+	assert.Nil(t, v.SetBin("sample", []byte("{\"test\": \"value\"}")))
+
+	data, err := v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"test\": \"value\"}", string(data))
+
+	assert.Nil(t, v.Delete("sample"))
+
+	_, err = v.GetBin("sample")
+	var itemNotFoundError *s.ItemNotFoundError
+	assert.True(t, errors.As(err, &itemNotFoundError))
+}
+
+func TestSetConflict(t *testing.T) {
+
+	kv := newMockKV()
+	v1 := newTestVault(t, kv, Config{})
+	v2 := newTestVault(t, kv, Config{})
+
+	// missing secrets are at version zero
+	version, err := v2.Version("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+
+	_, err = v1.SetBinVersion("sample", []byte("first"), 0)
+	assert.Nil(t, err)
+
+	var versionConflictError *s.VersionConflictError
+	_, err = v2.SetBinVersion("sample", []byte("second"), 0)
+	assert.True(t, errors.As(err, &versionConflictError))
+
+	version, err = v2.Version("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+
+	// the version expected by each writer is the one it read, regardless of the writes made by others
+	version, err = v1.SetBinVersion("sample", []byte("second"), version)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, version)
+
+	_, err = v1.SetBinVersion("sample", []byte("third"), 1)
+	assert.True(t, errors.As(err, &versionConflictError))
+
+	_, err = v2.SetBinVersion("sample", []byte("third"), version)
+	assert.Nil(t, err)
+
+	// writes without an expected version are not checked
+	assert.Nil(t, v1.SetBin("sample", []byte("fourth")))
+}
+
+func TestCreateExisting(t *testing.T) {
+
+	kv := newMockKV()
+	v1 := newTestVault(t, kv, Config{})
+	v2 := newTestVault(t, kv, Config{})
+
+	assert.Nil(t, v1.CreateBin("sample-lock", []byte("{\"ID\": \"first\"}")))
+
+	err := v2.CreateBin("sample-lock", []byte("{\"ID\": \"second\"}"))
+	var itemAlreadyExistsError *s.ItemAlreadyExistsError
+	assert.True(t, errors.As(err, &itemAlreadyExistsError))
+
+	assert.Nil(t, v1.Delete("sample-lock"))
+	assert.Nil(t, v2.CreateBin("sample-lock", []byte("{\"ID\": \"second\"}")))
+}
+
+func TestCreateDeleted(t *testing.T) {
+
+	kv := newMockKV()
+	v1 := newTestVault(t, kv, Config{})
+	v2 := newTestVault(t, kv, Config{})
+
+	assert.Nil(t, v1.CreateBin("sample-lock", []byte("{\"ID\": \"first\"}")))
+
+	// the latest version soft-deleted outside of the backend doesn't hold the lock
+	_, err := v1.client.Logical().Delete(v1.dataPath(v1.secretPath("sample-lock")))
+	assert.Nil(t, err)
+
+	assert.Nil(t, v2.CreateBin("sample-lock", []byte("{\"ID\": \"second\"}")))
+
+	err = v1.CreateBin("sample-lock", []byte("{\"ID\": \"third\"}"))
+	var itemAlreadyExistsError *s.ItemAlreadyExistsError
+	assert.True(t, errors.As(err, &itemAlreadyExistsError))
+
+	data, err := v1.GetBin("sample-lock")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"ID\": \"second\"}", string(data))
+}
+
+func TestChunks(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{ChunkSize: 10})
+
+	data := strings.Repeat("0123456789", 4) + "0123"
+	assert.Nil(t, v.Set("sample", data))
+	assert.Len(t, kv.secrets["vbk.chunks/sample/4"], 1)
+
+	out, err := v.Get("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	// previous contents remain readable from the versions referenced by the manifest
+	assert.Nil(t, v.Set("sample", strings.Repeat("9876543210", 3)))
+
+	manifest, _, err := v.read(v.secretPath("sample"), 1)
+	assert.Nil(t, err)
+
+	out, err = v.readChunks("sample", manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	// corrupted chunks are detected
+	kv.secrets["vbk.chunks/sample/0"][1]["value"] = "corrupted!"
+
+	_, err = v.Get("sample")
+	assert.NotNil(t, err)
+}
+
+func TestDropChunks(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{ChunkSize: 10})
+	v.config.Store = "kv"
+	v.kvVersion = KVv1
+
+	large := strings.Repeat("0123456789", 4)
+	assert.Nil(t, v.Set("sample", large))
+	assert.Len(t, kv.secrets, 5)
+
+	manifest, _, err := v.read(v.secretPath("sample"), 0)
+	assert.Nil(t, err)
+	assert.Contains(t, kv.secrets, fmt.Sprintf("vbk.chunks/sample/%s/3", chunkSet(manifest)))
+
+	// chunks no longer referenced are dropped, along with their set
+	assert.Nil(t, v.Set("sample", strings.Repeat("0123456789", 2)))
+	assert.Len(t, kv.secrets, 3)
+	assert.NotContains(t, kv.secrets, fmt.Sprintf("vbk.chunks/sample/%s/0", chunkSet(manifest)))
+
+	out, err := v.Get("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("0123456789", 2), out)
+
+	// content failing to be written leaves the chunks referenced by the manifest untouched
+	kv.failing = "/1"
+	assert.NotNil(t, v.Set("sample", strings.Repeat("9876543210", 2)))
+	kv.failing = ""
+
+	out, err = v.Get("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("0123456789", 2), out)
+
+	// writing the same content again reuses its set
+	assert.Nil(t, v.Set("sample", strings.Repeat("9876543210", 2)))
+	assert.Len(t, kv.secrets, 3)
+
+	// content no longer split drops all the chunks
+	assert.Nil(t, v.Set("sample", "small"))
+	assert.Len(t, kv.secrets, 1)
+
+	// the chunks are deleted along with the content
+	assert.Nil(t, v.Set("sample", large))
+	assert.Nil(t, v.Set("sample", large))
+	assert.Nil(t, v.Delete("sample"))
+	assert.Empty(t, kv.secrets)
+}
+
+func TestChunkNames(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{ChunkSize: 10})
+
+	// the chunks of a content don't clash with a content named after them
+	data := strings.Repeat("0123456789", 2)
+	assert.Nil(t, v.Set("sample", data))
+	assert.Nil(t, v.Set("sample-chunk-0", "other"))
+	assert.Nil(t, v.Set("sample/0", "other"))
+
+	out, err := v.Get("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestDeleteChunks(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{ChunkSize: 10})
+
+	assert.Nil(t, v.Set("sample", strings.Repeat("0123456789", 3)))
+	assert.Nil(t, v.Set("sample", strings.Repeat("0123456789", 2)))
+
+	assert.Nil(t, v.Delete("sample"))
+	assert.Empty(t, kv.secrets)
+}
+
+func TestGetVersion(t *testing.T) {
+
+	v := newTestVault(t, newMockKV(), Config{})
+
+	assert.Nil(t, v.SetBin("sample", []byte("first")))
+	assert.Nil(t, v.SetBin("sample", []byte("second")))
+
+	data, err := v.GetBinVersion("sample", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(data))
+
+	// reading a previous version doesn't affect check-and-set
+	assert.Nil(t, v.SetBin("sample", []byte("third")))
+
+	_, err = v.GetBinVersion("sample", 4)
+	var itemNotFoundError *s.ItemNotFoundError
+	assert.True(t, errors.As(err, &itemNotFoundError))
+}
+
+func TestRetention(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{
+		Retention:          &Retention{MaxVersions: 50, DeleteVersionAfter: 90 * 24 * time.Hour},
+		RetentionOverrides: []RetentionOverride{{Pattern: "prod-*", Retention: Retention{MaxVersions: 100}}},
+	})
+
+	assert.Nil(t, v.Set("sample", "first"))
+	assert.Nil(t, v.Set("sample", "second"))
+	assert.Equal(t, 1, kv.metadataWrites)
+	assert.Equal(t, float64(50), kv.metadata["vbk/sample"]["max_versions"])
+	assert.Equal(t, "2160h0m0s", kv.metadata["vbk/sample"]["delete_version_after"])
+
+	assert.Nil(t, v.Set("prod-sample", "first"))
+	assert.Equal(t, 2, kv.metadataWrites)
+	assert.Equal(t, float64(100), kv.metadata["vbk/prod-sample"]["max_versions"])
+	assert.Equal(t, "0s", kv.metadata["vbk/prod-sample"]["delete_version_after"])
+
+	// locks are not affected
+	assert.Nil(t, v.Create("sample-lock", "lock"))
+	assert.NotContains(t, kv.metadata, "vbk/sample-lock")
+
+	// settings already stored are not written again
+	v2 := newTestVault(t, kv, v.config)
+	assert.Nil(t, v2.Set("sample", "third"))
+	assert.Equal(t, 2, kv.metadataWrites)
+
+	// changed settings are updated
+	v.config.Retention = &Retention{MaxVersions: 20}
+	_, err := v.Get("sample")
+	assert.Nil(t, err)
+	assert.Nil(t, v.Set("sample", "fourth"))
+	assert.Equal(t, 3, kv.metadataWrites)
+	assert.Equal(t, float64(20), kv.metadata["vbk/sample"]["max_versions"])
+}
+
+func TestTransit(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{TransitMount: "transit"})
+
+	assert.Nil(t, v.SetBin("sample", []byte("first")))
+
+	// the content is encrypted with the key named after the prefix
+	value, ok := kv.secrets["vbk/sample"][0]["value"].(string)
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(value, "vault:v1:"))
+	assert.Equal(t, 1, kv.keys["vbk"])
+
+	// rotated keys are used for new versions, while previous ones remain readable
+	kv.keys["vbk"] = 2
+	assert.Nil(t, v.SetBin("sample", []byte("second")))
+	value, _ = kv.secrets["vbk/sample"][1]["value"].(string)
+	assert.True(t, strings.HasPrefix(value, "vault:v2:"))
+
+	out, err := v.GetBinVersion("sample", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(out))
+
+	out, err = v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(out))
+
+	// unencrypted content is still readable
+	plain := newTestVault(t, kv, Config{})
+	assert.Nil(t, plain.SetBin("legacy", []byte("legacy")))
+
+	out, err = v.GetBin("legacy")
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(out))
+
+	// encrypted content can't be read without Transit
+	_, err = plain.GetBin("sample")
+	assert.NotNil(t, err)
+
+	// a different key can be set
+	other := newTestVault(t, kv, Config{TransitMount: "transit", TransitKey: "states"})
+	assert.Nil(t, other.SetBin("other", []byte("other")))
+	assert.Equal(t, 1, kv.keys["states"])
+}
+
+func TestUpgrade(t *testing.T) {
+
+	kv := newMockKV()
+	plain := newTestVault(t, kv, Config{})
+	assert.Nil(t, plain.SetBin("sample", []byte("content")))
+
+	keyring, err := ParseKeyring("k1:" + testKey1)
+	assert.Nil(t, err)
+	v := newTestVault(t, kv, Config{Keyring: keyring})
+
+	// unencrypted content remains readable
+	out, err := v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(out))
+
+	upgraded, err := v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.Len(t, kv.secrets["vbk/sample"], 2)
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][1]["value"].(string), "aesgcm:k1:"))
+
+	upgraded, err = v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.False(t, upgraded)
+
+	// content encrypted with a previous key is re-encrypted with the current one
+	keyring, err = ParseKeyring("k2:" + testKey2 + ",k1:" + testKey1)
+	assert.Nil(t, err)
+	rotated := newTestVault(t, kv, Config{Keyring: keyring})
+
+	upgraded, err = rotated.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][2]["value"].(string), "aesgcm:k2:"))
+
+	out, err = rotated.GetBinVersion("sample", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(out))
+
+	// encrypted content can't be read without the keys
+	_, err = plain.GetBin("sample")
+	assert.NotNil(t, err)
+
+	// content encoded with a different codec is encoded again
+	zstd := newTestVault(t, kv, Config{Keyring: keyring, Codec: CodecZstd})
+
+	upgraded, err = zstd.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][3]["value"].(string), "aesgcm:k2:"))
+
+	out, err = rotated.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(out))
+
+	upgraded, err = zstd.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.False(t, upgraded)
+}
+
+func TestUpgradeTransit(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{TransitMount: "transit"})
+	assert.Nil(t, v.SetBin("sample", []byte("content")))
+
+	upgraded, err := v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.False(t, upgraded)
+
+	// content encrypted with a previous version of the key is rewrapped
+	kv.keys["vbk"] = 2
+
+	upgraded, err = v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.Equal(t, 1, kv.rewraps)
+	assert.Len(t, kv.secrets["vbk/sample"], 2)
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][1]["value"].(string), "vault:v2:"))
+
+	out, err := v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(out))
+
+	upgraded, err = v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.False(t, upgraded)
+
+	// content needing to be encoded again is encrypted from scratch
+	kv.keys["vbk"] = 3
+	zstd := newTestVault(t, kv, Config{TransitMount: "transit", Codec: CodecZstd})
+
+	upgraded, err = zstd.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.Equal(t, 1, kv.rewraps)
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][2]["value"].(string), "vault:v3:"))
+
+	out, err = zstd.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(out))
+}
+
+func TestUpgradeLegacyEncoding(t *testing.T) {
+
+	kv := newMockKV()
+	v := newTestVault(t, kv, Config{})
+
+	// encoded by previous versions, without the end of the ZLIB stream
+	kv.secrets["vbk/sample"] = []map[string]interface{}{{"value": "eJwAEgDt/3NvbWUgY29udGVudCwgZnVsbAAAAP//"}}
+
+	out, err := v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "some content, full", string(out))
+
+	upgraded, err := v.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.True(t, strings.HasPrefix(kv.secrets["vbk/sample"][1]["value"].(string), "vbk2:zlib:"))
+
+	out, err = v.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "some content, full", string(out))
+}
+
+func TestFormats(t *testing.T) {
+
+	kv := newMockKV()
+	encoded := newTestVault(t, kv, Config{})
+	plain := newTestVault(t, kv, Config{Format: FormatJSON, ChunkSize: 100})
+
+	state := `{"version": 4, "serial": 3, "lineage": "abc", "resources": []}`
+
+	// JSON objects are stored as fields
+	assert.Nil(t, plain.SetBin("json", []byte(state)))
+	assert.Equal(t, "json", kv.secrets["vbk/json"][0][formatField])
+	assert.Equal(t, "abc", kv.secrets["vbk/json"][0]["lineage"])
+
+	out, err := encoded.GetBin("json")
+	assert.Nil(t, err)
+	assert.JSONEq(t, state, string(out))
+
+	// other content is stored as text
+	assert.Nil(t, plain.CreateBin("text", []byte("some text")))
+	assert.Equal(t, "text", kv.secrets["vbk/text"][0][formatField])
+	assert.Equal(t, "some text", kv.secrets["vbk/text"][0]["value"])
+
+	out, err = encoded.GetBin("text")
+	assert.Nil(t, err)
+	assert.Equal(t, "some text", string(out))
+
+	// content exceeding the chunk size is stored as text chunks
+	large := `{"value": "` + strings.Repeat("a", 250) + `"}`
+	assert.Nil(t, plain.SetBin("large", []byte(large)))
+	assert.Equal(t, "text", kv.secrets["vbk/large"][0][formatField])
+	assert.Len(t, kv.secrets["vbk.chunks/large/2"], 1)
+
+	out, err = plain.GetBin("large")
+	assert.Nil(t, err)
+	assert.Equal(t, large, string(out))
+
+	// encoded content is still readable, and upgraded to the configured format
+	assert.Nil(t, encoded.SetBin("sample", []byte(state)))
+
+	out, err = plain.GetBin("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, state, string(out))
+
+	upgraded, err := plain.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.Equal(t, "json", kv.secrets["vbk/sample"][1][formatField])
+
+	upgraded, err = plain.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.False(t, upgraded)
+
+	upgraded, err = encoded.Upgrade("sample")
+	assert.Nil(t, err)
+	assert.True(t, upgraded)
+	assert.Nil(t, kv.secrets["vbk/sample"][2][formatField])
+}
+
+func TestSingleRenewal(t *testing.T) {
+
+	var logins int
+	var m sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m.Lock()
+		defer m.Unlock()
+
+		logins++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   fmt.Sprintf("token-%d", logins),
+			"lease_duration": 1,
+			"renewable":      false,
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	v, err := newWithLogin(Config{URL: srv.URL, KVVersion: KVv2}, "auth/approle/login", map[string]interface{}{})
+	assert.Nil(t, err)
+	defer v.Close()
+
+	// short-lived tokens are obtained again either by the renewal or on demand, without piling up renewals
+	for i := 0; i < 60; i++ {
+
+		assert.Nil(t, v.prepare())
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	assert.LessOrEqual(t, logins, 10)
+	assert.GreaterOrEqual(t, logins, 3)
+}
+
+func TestReloginFailure(t *testing.T) {
+
+	var logins int
+	var m sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m.Lock()
+		defer m.Unlock()
+
+		logins++
+		if logins > 1 {
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "token",
+			"lease_duration": 1,
+			"renewable":      false,
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	v, err := newWithLogin(Config{URL: srv.URL, KVVersion: KVv2}, "auth/approle/login", map[string]interface{}{})
+	assert.Nil(t, err)
+	defer v.Close()
+	assert.False(t, v.Expired())
+
+	// the renewal gives up after failing to log in again, leaving the client to be replaced
+	assert.Eventually(t, v.Expired, 5*time.Second, 50*time.Millisecond)
+
+	time.Sleep(time.Second)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 2, logins)
+}